@@ -0,0 +1,136 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"dnsproxy/monitoring"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	aclDenyRefused = "refused"
+	aclDenyClose   = "close"
+)
+
+// aclProtocols are the protocol names that access control rules can apply to
+var aclProtocols = []string{"https", "tls", "quic"}
+
+// errClientDenied is returned when a client is not permitted by the access control rules
+var errClientDenied = errors.New("client denied by access control rules")
+
+// aclRules are the access control rules in use, loaded from the server configuration by setupACL
+var aclRules = &atomic.Pointer[[]tACLRule]{}
+
+// parseACLRule parses an access control rule, which is "allow" or "deny", a comma separated list
+// of protocols or "*" for every protocol, and a comma separated list of networks
+func parseACLRule(value string) (tACLRule, error) {
+	action, rest, _ := strings.Cut(value, " ")
+	protocols, networks, _ := strings.Cut(strings.TrimSpace(rest), " ")
+
+	rule := tACLRule{}
+	switch strings.ToLower(action) {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+		rule.Allow = false
+	default:
+		return rule, fmt.Errorf("unknown action %s", action)
+	}
+
+	if protocols != "*" {
+		for _, proto := range parseList(protocols) {
+			proto = strings.ToLower(proto)
+			if !slices.Contains(aclProtocols, proto) {
+				return rule, fmt.Errorf("unknown protocol %s", proto)
+			}
+			rule.Protocols = append(rule.Protocols, proto)
+		}
+	}
+
+	for _, network := range parseList(networks) {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(network)
+			if addrErr != nil {
+				return rule, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rule.Networks = append(rule.Networks, prefix.Masked())
+	}
+	if len(rule.Networks) == 0 {
+		return rule, fmt.Errorf("at least one network is required")
+	}
+	return rule, nil
+}
+
+// clientAddr returns the IP address from the given remote address
+func clientAddr(remoteAddr string) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// clientAllowed returns true if the client with the given remote address may use the given
+// protocol. The access control rules are checked in order and the first matching rule is used.
+// Clients that don't match any rule are allowed.
+func clientAllowed(proto, remoteAddr string) bool {
+	rules := aclRules.Load()
+	if rules == nil || len(*rules) == 0 {
+		return true
+	}
+
+	addr, ok := clientAddr(remoteAddr)
+	if !ok {
+		return false
+	}
+	for _, rule := range *rules {
+		if rule.Protocols != nil && !slices.Contains(rule.Protocols, proto) {
+			continue
+		}
+		for _, network := range rule.Networks {
+			if network.Contains(addr) {
+				return rule.Allow
+			}
+		}
+	}
+	return true
+}
+
+// setupACL loads the access control rules from the server configuration
+func setupACL() {
+	rules := serverConfig.ACLRules
+	aclRules.Store(&rules)
+}
+
+// recordClientDenied counts and logs a client that was denied by the access control rules
+func recordClientDenied(proto, remoteAddr string) {
+	monitoring.RecordQueryDenied()
+	log.PDebug("Client denied by access control rules", map[string]any{
+		"proto":   proto,
+		"from_ip": remoteAddr,
+	})
+}
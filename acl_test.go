@@ -0,0 +1,142 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseACLRule(t *testing.T) {
+	rule, err := parseACLRule("allow tls,QUIC 10.0.0.0/8, 192.0.2.1, 2001:db8::1/32")
+	if err != nil {
+		t.Fatalf("Error parsing rule: %s", err.Error())
+	}
+	if !rule.Allow || len(rule.Protocols) != 2 || rule.Protocols[1] != "quic" {
+		t.Errorf("Unexpected rule %+v", rule)
+	}
+	if len(rule.Networks) != 3 || rule.Networks[1].String() != "192.0.2.1/32" || rule.Networks[2].String() != "2001:db8::/32" {
+		t.Errorf("Unexpected networks %v", rule.Networks)
+	}
+
+	rule, err = parseACLRule("deny * 0.0.0.0/0")
+	if err != nil {
+		t.Fatalf("Error parsing rule: %s", err.Error())
+	}
+	if rule.Allow || rule.Protocols != nil {
+		t.Errorf("Unexpected rule %+v", rule)
+	}
+
+	for _, value := range []string{"permit * 10.0.0.0/8", "allow udp 10.0.0.0/8", "allow *", "deny * 10.0.0.0/33", "deny * example.com"} {
+		if _, err := parseACLRule(value); err == nil {
+			t.Errorf("Invalid rule '%s' was accepted", value)
+		}
+	}
+}
+
+// setTestACLRules replaces the access control rules until the test finishes
+func setTestACLRules(t *testing.T, values ...string) {
+	rules := []tACLRule{}
+	for _, value := range values {
+		rule, err := parseACLRule(value)
+		if err != nil {
+			t.Fatalf("Error parsing rule: %s", err.Error())
+		}
+		rules = append(rules, rule)
+	}
+
+	current := aclRules.Load()
+	aclRules.Store(&rules)
+	t.Cleanup(func() { aclRules.Store(current) })
+}
+
+func TestClientAllowed(t *testing.T) {
+	setTestACLRules(t)
+	if !clientAllowed("tls", "192.0.2.1:1234") {
+		t.Errorf("Client was denied without any rules")
+	}
+
+	setTestACLRules(t,
+		"deny https 192.0.2.0/24",
+		"allow * 192.0.2.0/24, 2001:db8::/32",
+		"deny * 0.0.0.0/0, ::/0",
+	)
+
+	for _, test := range []struct {
+		proto    string
+		addr     string
+		expected bool
+	}{
+		{"tls", "192.0.2.1:1234", true},
+		{"quic", "[::ffff:192.0.2.1]:1234", true},
+		{"https", "192.0.2.1:1234", false},
+		{"https", "[2001:db8::1]:443", true},
+		{"tls", "198.51.100.1:1234", false},
+		{"quic", "[2001:db9::1]:1234", false},
+		{"tls", "not an address", false},
+	} {
+		if clientAllowed(test.proto, test.addr) != test.expected {
+			t.Errorf("Unexpected result for %s from %s, expected %v", test.proto, test.addr, test.expected)
+		}
+	}
+}
+
+func TestClientDenied(t *testing.T) {
+	setTestACLRules(t, "deny * 127.0.0.0/8")
+
+	conn, err := tls.Dial("tcp", "127.0.0.1:8853", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error connecting to DOT: %s", err.Error())
+	}
+	defer conn.Close()
+	query := buildTestQuery("example.com.", false)
+	conn.Write(query)
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		t.Fatalf("Error reading reply: %s", err.Error())
+	}
+	replyData := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, replyData); err != nil {
+		t.Fatalf("Error reading reply: %s", err.Error())
+	}
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(replyData); err != nil {
+		t.Fatalf("Error parsing reply: %s", err.Error())
+	}
+	if reply.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Unexpected rcode %s", reply.RCode)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Post("https://127.0.0.1:8443/dns-query", "application/dns-message", bytes.NewBuffer(query[2:]))
+	if err != nil {
+		t.Fatalf("Error connecting to DOH: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Errorf("Unexpected HTTP response code %d", resp.StatusCode)
+	}
+}
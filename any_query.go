@@ -0,0 +1,74 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"dnsproxy/monitoring"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// anyUpstreamName is recorded as the upstream for ANY queries answered by the ANY policy
+const anyUpstreamName = "any"
+
+const (
+	anyResponseHINFO   = "hinfo"
+	anyResponseNotImp  = "notimp"
+	anyResponseForward = "forward"
+)
+
+// anyHINFOTTL is the TTL of the synthesised HINFO record, as suggested by RFC 8482
+const anyHINFOTTL = 3789
+
+// processAnyQuery answers queries with a QTYPE of ANY according to the configured policy, either
+// with a minimal HINFO record (RFC 8482 section 4.2) or NOTIMP. Returns nil if the message isn't
+// an ANY query or ANY queries are forwarded.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func processAnyQuery(remoteAddr string, message []byte) []byte {
+	if serverConfig.AnyQueryResponse == anyResponseForward {
+		return nil
+	}
+
+	q, ok := questionOf(message)
+	if !ok || q.Type != dnsmessage.TypeALL {
+		return nil
+	}
+
+	monitoring.RecordQueryAny()
+	log.PDebug("Answered ANY query", map[string]any{
+		"from_ip":  remoteAddr,
+		"name":     q.Name.String(),
+		"response": serverConfig.AnyQueryResponse,
+	})
+
+	if serverConfig.AnyQueryResponse == anyResponseNotImp {
+		return buildErrorReply(message, dnsmessage.RCodeNotImplemented, nil)
+	}
+
+	// HINFO is two character strings, the CPU is "RFC8482" and the OS is empty
+	hinfo := append([]byte{7}, "RFC8482"...)
+	hinfo = append(hinfo, 0)
+	return buildReply(message, localAnswer{
+		rcode: dnsmessage.RCodeSuccess,
+		answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeHINFO, Class: q.Class, TTL: anyHINFOTTL},
+			Body:   &dnsmessage.UnknownResource{Type: dnsmessage.TypeHINFO, Data: hinfo},
+		}},
+	})
+}
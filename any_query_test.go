@@ -0,0 +1,91 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildTestAnyQuery(name string) []byte {
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeALL,
+		Class: dnsmessage.ClassINET,
+	})
+	message, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+	binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+	return message
+}
+
+func TestAnyQuery(t *testing.T) {
+	setTestConfig(t, func(config *tServerConfig) {
+		config.AnyQueryResponse = anyResponseHINFO
+	})
+
+	if reply := processAnyQuery("127.0.0.1:1234", buildTestQuery("example.com.", false)); reply != nil {
+		t.Errorf("A query was answered by the ANY policy")
+	}
+
+	query := func() *dnsmessage.Message {
+		replyData := processAnyQuery("127.0.0.1:1234", buildTestAnyQuery("example.com."))
+		if replyData == nil {
+			t.Fatalf("ANY query was not answered")
+		}
+		reply := &dnsmessage.Message{}
+		if err := reply.Unpack(replyData[2:]); err != nil {
+			t.Fatalf("Error parsing reply: %s", err.Error())
+		}
+		return reply
+	}
+
+	reply := query()
+	if reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 1 {
+		t.Fatalf("Unexpected HINFO reply %s %+v", reply.RCode, reply.Answers)
+	}
+	hinfo := reply.Answers[0]
+	if hinfo.Header.Type != dnsmessage.TypeHINFO || hinfo.Header.Name.String() != "example.com." {
+		t.Errorf("Unexpected HINFO record %+v", hinfo.Header)
+	}
+	if data := hinfo.Body.(*dnsmessage.UnknownResource).Data; !bytes.Equal(data, []byte("\x07RFC8482\x00")) {
+		t.Errorf("Unexpected HINFO data %q", data)
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.AnyQueryResponse = anyResponseNotImp
+	})
+	if reply := query(); reply.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("Unexpected rcode %s", reply.RCode)
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.AnyQueryResponse = anyResponseForward
+	})
+	if reply := processAnyQuery("127.0.0.1:1234", buildTestAnyQuery("example.com.")); reply != nil {
+		t.Errorf("ANY query was answered when it should be forwarded")
+	}
+}
@@ -0,0 +1,335 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bufio"
+	"dnsproxy/monitoring"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// blocklistUpstreamName is recorded as the upstream for queries that were blocked
+const blocklistUpstreamName = "blocklist"
+
+const (
+	blockResponseNXDomain = "nxdomain"
+	blockResponseRefused  = "refused"
+	blockResponseNull     = "null"
+	blockResponseCustom   = "custom"
+)
+
+// blocklistRules are the domains loaded from the blocklist and allowlist files
+type blocklistRules struct {
+	blocked *domainTrie
+	allowed *domainTrie
+}
+
+// blocklist holds the loaded rules, or nil if there are no blocklists. The rules are replaced as a
+// whole when the files are reloaded.
+var blocklist = &atomic.Pointer[blocklistRules]{}
+
+// blocklistWatcher reloads the blocklist and allowlist files when they change
+var blocklistWatcher *fileWatcher
+
+// hostsFileNames are names commonly found in hosts files that should never be blocked
+var hostsFileNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+func setupBlocklist() error {
+	closeBlocklist()
+	blocklist.Store(nil)
+	if len(serverConfig.BlocklistPaths) == 0 {
+		return nil
+	}
+
+	rules, err := loadBlocklistRules()
+	if err != nil {
+		monitoring.RecordBlocklistError()
+		return err
+	}
+	blocklist.Store(rules)
+
+	if serverConfig.BlocklistAutoReload {
+		watcher, err := newFileWatcher(slices.Concat(serverConfig.BlocklistPaths, serverConfig.AllowlistPaths), reloadBlocklist)
+		if err != nil {
+			return fmt.Errorf("unable to watch blocklist files: %s", err.Error())
+		}
+		blocklistWatcher = watcher
+	}
+	return nil
+}
+
+func closeBlocklist() {
+	if blocklistWatcher != nil {
+		blocklistWatcher.Close()
+		blocklistWatcher = nil
+	}
+}
+
+// reloadBlocklist loads the blocklist and allowlist files again and replaces the current rules. If
+// any file can't be loaded the current rules are kept.
+func reloadBlocklist() {
+	rules, err := loadBlocklistRules()
+	if err != nil {
+		monitoring.RecordBlocklistError()
+		log.PError("Error reloading blocklists, keeping the current rules", map[string]any{
+			"error": err.Error(),
+		})
+		return
+	}
+	blocklist.Store(rules)
+	log.PInfo("Reloaded blocklists", map[string]any{
+		"blocked": rules.blocked.Len(),
+		"allowed": rules.allowed.Len(),
+	})
+}
+
+// loadBlocklistRules reads every blocklist and allowlist file
+func loadBlocklistRules() (*blocklistRules, error) {
+	rules := &blocklistRules{blocked: newDomainTrie(), allowed: newDomainTrie()}
+	invalid := 0
+	for _, path := range serverConfig.BlocklistPaths {
+		n, err := loadBlocklistFile(rules.blocked, path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load blocklist %s: %s", path, err.Error())
+		}
+		invalid += n
+	}
+	for _, path := range serverConfig.AllowlistPaths {
+		n, err := loadBlocklistFile(rules.allowed, path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load allowlist %s: %s", path, err.Error())
+		}
+		invalid += n
+	}
+	monitoring.SetBlocklistRules(rules.blocked.Len(), rules.allowed.Len(), invalid)
+	return rules, nil
+}
+
+// loadBlocklistFile adds the domains from the blocklist or allowlist file at the given path to the
+// trie. Each line of the file can be a domain name, a hosts file entry, or an adblock style
+// ||domain^ rule. Lines that can't be parsed are skipped. Returns the number of skipped lines.
+func loadBlocklistFile(trie *domainTrie, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	added := 0
+	invalid := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		domains, ok := parseBlocklistLine(scanner.Text())
+		if !ok {
+			invalid++
+			continue
+		}
+		for _, domain := range domains {
+			if trie.Add(domain) {
+				added++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	log.PInfo("Loaded blocklist", map[string]any{
+		"path":    path,
+		"rules":   added,
+		"invalid": invalid,
+	})
+	return invalid, nil
+}
+
+// parseBlocklistLine returns the domains from a single line of a blocklist file. Comments and empty
+// lines have no domains. Returns false if the line is not valid.
+func parseBlocklistLine(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil, true
+	}
+	if before, _, found := strings.Cut(line, "#"); found {
+		line = strings.TrimSpace(before)
+		if line == "" {
+			return nil, true
+		}
+	}
+
+	// Adblock style, only rules that block a domain and its subdomains are supported
+	if rule, ok := strings.CutPrefix(line, "||"); ok {
+		domain, options, found := strings.Cut(rule, "^")
+		if !found || options != "" || !isValidDomain(domain) {
+			return nil, false
+		}
+		return []string{domain}, true
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		domain := strings.TrimPrefix(fields[0], "*.")
+		if !isValidDomain(domain) {
+			return nil, false
+		}
+		return []string{domain}, true
+	}
+
+	// Hosts file style, an IP address followed by one or more names
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return nil, false
+	}
+	domains := []string{}
+	for _, name := range fields[1:] {
+		if hostsFileNames[strings.ToLower(name)] {
+			continue
+		}
+		if !isValidDomain(name) {
+			return nil, false
+		}
+		domains = append(domains, name)
+	}
+	return domains, true
+}
+
+// isValidDomain returns true if the given name is a valid domain name. Underscores are permitted
+// as they are commonly used in service names.
+func isValidDomain(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// processBlockedQuery returns the configured block response if the name in the given DNS message
+// is on a blocklist and not on an allowlist, otherwise nil.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func processBlockedQuery(remoteAddr string, message []byte) []byte {
+	rules := blocklist.Load()
+	if rules == nil {
+		return nil
+	}
+
+	q, ok := questionOf(message)
+	if !ok || !rules.blocked.Match(q.Name.String()) {
+		return nil
+	}
+	if rules.allowed.Match(q.Name.String()) {
+		log.PDebug("Allowed blocked DNS query", map[string]any{
+			"from_ip": remoteAddr,
+			"name":    q.Name.String(),
+			"type":    q.Type.String(),
+		})
+		return nil
+	}
+
+	monitoring.RecordQueryBlocked()
+	log.PDebug("Blocked DNS query", map[string]any{
+		"from_ip": remoteAddr,
+		"name":    q.Name.String(),
+		"type":    q.Type.String(),
+	})
+	return buildReply(message, blockedAnswer(q))
+}
+
+// blockedAnswer returns the configured block response to the given question
+func blockedAnswer(q dnsmessage.Question) localAnswer {
+	ede := &extendedError{code: edeBlocked, text: "blocked by blocklist"}
+	switch serverConfig.BlocklistResponse {
+	case blockResponseNXDomain:
+		return localAnswer{rcode: dnsmessage.RCodeNameError, ede: ede}
+	case blockResponseRefused:
+		return localAnswer{rcode: dnsmessage.RCodeRefused, ede: ede}
+	}
+
+	addrs := serverConfig.BlocklistAddrs
+	if serverConfig.BlocklistResponse == blockResponseNull {
+		addrs = []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()}
+	}
+	answer := localAnswer{rcode: dnsmessage.RCodeSuccess, ede: ede}
+	answer.answers = addressRecords(q, addrs, serverConfig.BlocklistTTL)
+	return answer
+}
+
+// addressRecords returns A or AAAA records answering the given question with any of the given
+// addresses that match the type of the question.
+func addressRecords(q dnsmessage.Question, addrs []netip.Addr, ttl uint32) []dnsmessage.Resource {
+	records := []dnsmessage.Resource{}
+	for _, addr := range addrs {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			records = append(records, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6() && !addr.Is4In6():
+			records = append(records, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return records
+}
+
+// questionOf returns the question from the given DNS message. Returns false if the message is not
+// a query with a single question.
+// The message MUST include a 2-byte big-endian length at the start.
+func questionOf(message []byte) (dnsmessage.Question, bool) {
+	if len(message) < 14 || message[6] != 0 || message[7] != 1 {
+		return dnsmessage.Question{}, false
+	}
+	p := dnsmessage.Parser{}
+	header, err := p.Start(message[2:])
+	if err != nil || header.Response {
+		return dnsmessage.Question{}, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsmessage.Question{}, false
+	}
+	return q, true
+}
@@ -0,0 +1,228 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDomainTrie(t *testing.T) {
+	trie := newDomainTrie()
+	trie.Add("ads.example.com")
+	trie.Add("Tracker.Example.")
+	if trie.Add("ads.example.com.") {
+		t.Errorf("Duplicate name added to trie")
+	}
+	if trie.Len() != 2 {
+		t.Errorf("Unexpected trie size %d", trie.Len())
+	}
+
+	for name, expected := range map[string]bool{
+		"ads.example.com.":     true,
+		"x.y.ADS.example.com.": true,
+		"example.com.":         false,
+		"notads.example.com.":  false,
+		"tracker.example.":     true,
+		"cdn.tracker.example.": true,
+		"tracker.example.org.": false,
+		".":                    false,
+	} {
+		if trie.Match(name) != expected {
+			t.Errorf("Unexpected match result for %s, expected %v", name, expected)
+		}
+	}
+}
+
+func TestParseBlocklistLine(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"example.com":                         {"example.com"},
+		"  *.example.com  ":                   {"example.com"},
+		"0.0.0.0 ads.example tracker.example": {"ads.example", "tracker.example"},
+		"127.0.0.1 localhost":                 {},
+		"::1 ip6-localhost ip6-loopback":      {},
+		"||ads.example.com^":                  {"ads.example.com"},
+		"ads.example.com # comment":           {"ads.example.com"},
+		"# comment":                           nil,
+		"! adblock comment":                   nil,
+		"[Adblock Plus 2.0]":                  nil,
+		"":                                    nil,
+	} {
+		domains, ok := parseBlocklistLine(line)
+		if !ok {
+			t.Errorf("Valid line '%s' was rejected", line)
+			continue
+		}
+		if !slices.Equal(domains, expected) {
+			t.Errorf("Unexpected domains from '%s': %v", line, domains)
+		}
+	}
+
+	for _, line := range []string{"||example.com^$third-party", "||example.com/path", "not a domain", "exa mple..com", "192.0.2.1"} {
+		if _, ok := parseBlocklistLine(line); ok {
+			t.Errorf("Invalid line '%s' was accepted", line)
+		}
+	}
+}
+
+func TestBlockedQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("# test\nblocked.example.\n0.0.0.0 hosts.example\n||adblock.example^\nnot valid\n"), 0644); err != nil {
+		t.Fatalf("Error writing blocklist: %s", err.Error())
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.BlocklistPaths = []string{path}
+	})
+	t.Cleanup(func() { closeBlocklist(); blocklist.Store(nil) })
+	if err := setupBlocklist(); err != nil {
+		t.Fatalf("Error loading blocklist: %s", err.Error())
+	}
+	if n := blocklist.Load().blocked.Len(); n != 3 {
+		t.Errorf("Unexpected number of blocked domains %d", n)
+	}
+
+	if reply := processBlockedQuery("127.0.0.1:1234", buildTestQuery("example.com.", false)); reply != nil {
+		t.Errorf("Unblocked name was blocked")
+	}
+
+	query := func(name string) *dnsmessage.Message {
+		replyData := processBlockedQuery("127.0.0.1:1234", buildTestQuery(name, false))
+		if replyData == nil {
+			t.Fatalf("Blocked name %s was not blocked", name)
+		}
+		reply := &dnsmessage.Message{}
+		if err := reply.Unpack(replyData[2:]); err != nil {
+			t.Fatalf("Error parsing reply: %s", err.Error())
+		}
+		return reply
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.BlocklistResponse = blockResponseNXDomain
+	})
+	if reply := query("www.blocked.example."); reply.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Unexpected rcode %s", reply.RCode)
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.BlocklistResponse = blockResponseRefused
+	})
+	if reply := query("hosts.example."); reply.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Unexpected rcode %s", reply.RCode)
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.BlocklistResponse = blockResponseNull
+	})
+	reply := query("adblock.example.")
+	if len(reply.Answers) != 1 || reply.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{} {
+		t.Errorf("Unexpected null reply %+v", reply.Answers)
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.BlocklistResponse = blockResponseCustom
+		config.BlocklistAddrs = []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}
+	})
+	reply = query("adblock.example.")
+	if len(reply.Answers) != 1 || reply.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("Unexpected custom reply %+v", reply.Answers)
+	}
+	if reply.Answers[0].Header.TTL != serverConfig.BlocklistTTL {
+		t.Errorf("Unexpected TTL %d", reply.Answers[0].Header.TTL)
+	}
+}
+
+func TestAllowlistAndReload(t *testing.T) {
+	dir := t.TempDir()
+	blockPath := filepath.Join(dir, "blocklist.txt")
+	allowPath := filepath.Join(dir, "allowlist.txt")
+	if err := os.WriteFile(blockPath, []byte("example.com\n"), 0644); err != nil {
+		t.Fatalf("Error writing blocklist: %s", err.Error())
+	}
+	if err := os.WriteFile(allowPath, []byte("good.example.com\n"), 0644); err != nil {
+		t.Fatalf("Error writing allowlist: %s", err.Error())
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.BlocklistPaths = []string{blockPath}
+		config.AllowlistPaths = []string{allowPath}
+		config.BlocklistAutoReload = true
+		config.BlocklistResponse = blockResponseNXDomain
+	})
+	t.Cleanup(func() { closeBlocklist(); blocklist.Store(nil) })
+	if err := setupBlocklist(); err != nil {
+		t.Fatalf("Error loading blocklist: %s", err.Error())
+	}
+
+	blocked := func(name string) bool {
+		return processBlockedQuery("127.0.0.1:1234", buildTestQuery(name, false)) != nil
+	}
+	if !blocked("www.example.com.") {
+		t.Errorf("Blocked name was not blocked")
+	}
+	if blocked("good.example.com.") || blocked("www.good.example.com.") {
+		t.Errorf("Allowed name was blocked")
+	}
+
+	waitFor := func(condition func() bool) bool {
+		for range 100 {
+			if condition() {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	// Replace the file the way most tools do, by renaming a new file over it
+	newPath := filepath.Join(dir, "blocklist.txt.new")
+	if err := os.WriteFile(newPath, []byte("example.com\nexample.net\n"), 0644); err != nil {
+		t.Fatalf("Error writing blocklist: %s", err.Error())
+	}
+	if err := os.Rename(newPath, blockPath); err != nil {
+		t.Fatalf("Error replacing blocklist: %s", err.Error())
+	}
+	if !waitFor(func() bool { return blocked("example.net.") }) {
+		t.Fatalf("Blocklist was not reloaded after it was replaced")
+	}
+
+	if err := os.WriteFile(allowPath, []byte("good.example.com\nexample.net\n"), 0644); err != nil {
+		t.Fatalf("Error writing allowlist: %s", err.Error())
+	}
+	if !waitFor(func() bool { return !blocked("example.net.") }) {
+		t.Fatalf("Allowlist was not reloaded after it was written")
+	}
+
+	// The current rules are kept if a file can't be loaded
+	rules := blocklist.Load()
+	if err := os.Remove(blockPath); err != nil {
+		t.Fatalf("Error removing blocklist: %s", err.Error())
+	}
+	time.Sleep(2 * fileWatchDelay)
+	if blocklist.Load() != rules || !blocked("www.example.com.") {
+		t.Errorf("Rules were replaced after a failed reload")
+	}
+}
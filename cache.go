@@ -0,0 +1,522 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// cacheUpstreamName is recorded as the upstream for replies that were served from the cache
+const cacheUpstreamName = "cache"
+
+// cacheShardCount is the number of independently locked shards the cache is split into
+const cacheShardCount = 16
+
+// cacheEntryOverhead is the approximate memory used by each cache entry in addition to the reply
+const cacheEntryOverhead = 128
+
+var errMalformedMessage = errors.New("malformed DNS message")
+
+// dnsCache holds replies from upstream servers, or nil if caching is disabled
+var dnsCache *responseCache
+
+// cacheState describes how a cached reply can be used
+type cacheState int
+
+const (
+	// cacheMiss means there is no usable reply in the cache
+	cacheMiss cacheState = iota
+	// cacheHit means the reply has not expired
+	cacheHit
+	// cachePrefetch means the reply has not expired, but is popular and close to expiring so should
+	// be refreshed
+	cachePrefetch
+	// cacheStale means the reply has expired but is within the serve-stale window
+	cacheStale
+)
+
+// cacheOptions are the limits and behaviour of the response cache
+type cacheOptions struct {
+	maxEntries       int
+	maxBytes         int64
+	staleFor         time.Duration
+	staleTTL         uint32
+	prefetchFraction float64
+	prefetchMinHits  int
+}
+
+func cacheOptionsFromConfig() cacheOptions {
+	return cacheOptions{
+		maxEntries:       serverConfig.CacheMaxEntries,
+		maxBytes:         serverConfig.CacheMaxMemory,
+		staleFor:         serverConfig.CacheServeStale,
+		staleTTL:         serverConfig.CacheStaleTTL,
+		prefetchFraction: serverConfig.CachePrefetchFraction,
+		prefetchMinHits:  serverConfig.CachePrefetchMinHits,
+	}
+}
+
+// cacheKey identifies the question a cached reply answers. Replies to queries with an OPT record
+// are kept apart from those without, as a reply may only include an OPT record if the query did
+// (RFC 6891).
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+	opt   bool
+	do    bool
+	cd    bool
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// reply is the packed reply, including the 2-byte length
+	reply []byte
+	// ttlOffsets are the positions of the TTL of every record in the reply
+	ttlOffsets []int
+	stored     time.Time
+	expires    time.Time
+	// hits is the number of times the reply was served before it expired
+	hits        int
+	prefetching bool
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.reply) + len(e.key.name) + 4*len(e.ttlOffsets) + cacheEntryOverhead)
+}
+
+type cacheShard struct {
+	lock       *sync.Mutex
+	entries    map[cacheKey]*list.Element
+	lru        *list.List
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+	options    cacheOptions
+}
+
+// responseCache is an in-memory cache of replies from upstream servers. Entries expire with the
+// lowest TTL of the records in the reply, and the least recently used entries are evicted when
+// the cache is over its entry or memory limits. Expired entries can be kept for a while longer to
+// be served if the upstream servers can't be reached (RFC 8767), and popular entries are refreshed
+// before they expire.
+type responseCache struct {
+	shards []*cacheShard
+}
+
+// newResponseCache returns an empty cache. The entry and memory limits are split evenly between the
+// shards, rounding down, so the cache as a whole never goes over them.
+func newResponseCache(options cacheOptions) *responseCache {
+	c := &responseCache{shards: make([]*cacheShard, cacheShardCount)}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			lock:       &sync.Mutex{},
+			entries:    map[cacheKey]*list.Element{},
+			lru:        list.New(),
+			maxEntries: options.maxEntries / cacheShardCount,
+			maxBytes:   options.maxBytes / cacheShardCount,
+			options:    options,
+		}
+	}
+	return c
+}
+
+func (c *responseCache) shardFor(key cacheKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.name))
+	return c.shards[(h.Sum32()^uint32(key.qtype))%cacheShardCount]
+}
+
+// Get returns the cached reply to the given DNS message, or nil if there isn't one. The TTLs in
+// the reply are reduced by the time it has been cached for, and the message ID and question
+// name are copied from the message. If the reply has expired but is still within the serve-stale
+// window then every TTL is set to the stale TTL. The state tells the caller if the reply is stale
+// or should be prefetched.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func (c *responseCache) Get(key cacheKey, message []byte) ([]byte, cacheState) {
+	return c.shardFor(key).get(key, message, time.Now())
+}
+
+// Set adds the given reply from an upstream server to the cache, if it can be cached.
+// The reply MUST include a 2-byte big-endian length at the start.
+func (c *responseCache) Set(key cacheKey, reply []byte) {
+	entry := newCacheEntry(key, reply, time.Now())
+	if entry == nil {
+		return
+	}
+	c.shardFor(key).set(entry)
+}
+
+// Len returns the number of entries in the cache
+func (c *responseCache) Len() int {
+	n := 0
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		n += shard.lru.Len()
+		shard.lock.Unlock()
+	}
+	return n
+}
+
+func (s *cacheShard) get(key cacheKey, message []byte, now time.Time) ([]byte, cacheState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, cacheMiss
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires.Add(s.options.staleFor)) {
+		s.remove(element)
+		return nil, cacheMiss
+	}
+	s.lru.MoveToFront(element)
+
+	if !now.Before(entry.expires) {
+		return entry.staleReplyFor(message, s.options.staleTTL), cacheStale
+	}
+
+	entry.hits++
+	if s.shouldPrefetch(entry, now) {
+		entry.prefetching = true
+		return entry.replyFor(message, now), cachePrefetch
+	}
+	return entry.replyFor(message, now), cacheHit
+}
+
+// shouldPrefetch returns true if the entry has been used enough times and is within the prefetch
+// fraction of its original TTL
+func (s *cacheShard) shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	if s.options.prefetchFraction <= 0 || entry.prefetching || entry.hits < s.options.prefetchMinHits {
+		return false
+	}
+	ttl := entry.expires.Sub(entry.stored)
+	remaining := entry.expires.Sub(now)
+	return remaining <= time.Duration(float64(ttl)*s.options.prefetchFraction)
+}
+
+func (s *cacheShard) set(entry *cacheEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[entry.key]; ok {
+		s.remove(element)
+	}
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	s.bytes += entry.size()
+
+	for s.lru.Len() > s.maxEntries || s.bytes > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *cacheShard) remove(element *list.Element) {
+	entry := s.lru.Remove(element).(*cacheEntry)
+	delete(s.entries, entry.key)
+	s.bytes -= entry.size()
+}
+
+// replyFor returns a copy of the cached reply for the given DNS message, with TTLs reduced by the
+// time the reply has been cached for
+func (e *cacheEntry) replyFor(message []byte, now time.Time) []byte {
+	reply := e.copyFor(message)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, offset := range e.ttlOffsets {
+		ttl := binary.BigEndian.Uint32(reply[offset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(reply[offset:], ttl)
+	}
+	return reply
+}
+
+// staleReplyFor returns a copy of the cached reply for the given DNS message, with every TTL set
+// to the given stale TTL
+func (e *cacheEntry) staleReplyFor(message []byte, ttl uint32) []byte {
+	reply := e.copyFor(message)
+	for _, offset := range e.ttlOffsets {
+		binary.BigEndian.PutUint32(reply[offset:], ttl)
+	}
+	return reply
+}
+
+// copyFor returns a copy of the cached reply for the given DNS message
+func (e *cacheEntry) copyFor(message []byte) []byte {
+	return copyReplyFor(e.reply, message)
+}
+
+// copyReplyFor returns a copy of the given reply, modified to answer the given DNS message from
+// another client. The message ID and the case of the question name are copied from the message.
+// Both the reply and message MUST include a 2-byte big-endian length at the start.
+func copyReplyFor(reply, message []byte) []byte {
+	replyCopy := make([]byte, len(reply))
+	copy(replyCopy, reply)
+
+	// Use the clients message ID, and the case of the name it asked for in case it is relying on
+	// the case for security (draft-vixie-dnsext-dns0x20)
+	copy(replyCopy[2:4], message[2:4])
+	if nameEnd, err := skipName(message[2:], 12); err == nil && len(replyCopy) >= 2+nameEnd {
+		copy(replyCopy[14:2+nameEnd], message[14:2+nameEnd])
+	}
+
+	return replyCopy
+}
+
+// newCacheEntry returns a cache entry for the given reply, or nil if the reply can't be cached.
+// Successful replies with at least one answer are cached for their lowest TTL. NXDOMAIN and NODATA
+// replies are cached using the SOA record from the authority section (RFC 2308), and aren't cached
+// if there isn't one.
+// The reply MUST include a 2-byte big-endian length at the start.
+func newCacheEntry(key cacheKey, reply []byte, now time.Time) *cacheEntry {
+	if len(reply) < 14 {
+		return nil
+	}
+	header := reply[2:14]
+	truncated := header[2]&0x02 != 0
+	rcode := dnsmessage.RCode(header[3] & 0x0f)
+	answers := binary.BigEndian.Uint16(header[6:8])
+	positive := rcode == dnsmessage.RCodeSuccess && answers > 0
+	negative := rcode == dnsmessage.RCodeNameError || (rcode == dnsmessage.RCodeSuccess && answers == 0)
+	if truncated || (!positive && !negative) {
+		return nil
+	}
+
+	stored := make([]byte, len(reply))
+	copy(stored, reply)
+	if negative && !setNegativeTTL(stored[2:], serverConfig.CacheNegativeMaxTTL) {
+		return nil
+	}
+
+	offsets, minTTL, err := recordTTLs(stored[2:])
+	if err != nil || minTTL == 0 {
+		return nil
+	}
+	for i := range offsets {
+		offsets[i] += 2
+	}
+
+	return &cacheEntry{
+		key:        key,
+		reply:      stored,
+		ttlOffsets: offsets,
+		stored:     now,
+		expires:    now.Add(time.Duration(minTTL) * time.Second),
+	}
+}
+
+// cacheKeyFor returns the cache key for the given DNS message. Returns false if the message is
+// not a standard query with a single question, and therefore can't be answered from the cache.
+// The message MUST include a 2-byte big-endian length at the start.
+func cacheKeyFor(message []byte) (cacheKey, bool) {
+	if len(message) < 14 || binary.BigEndian.Uint16(message[6:8]) != 1 {
+		return cacheKey{}, false
+	}
+
+	p := dnsmessage.Parser{}
+	header, err := p.Start(message[2:])
+	if err != nil || header.Response || header.OpCode != 0 {
+		return cacheKey{}, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return cacheKey{}, false
+	}
+	key := cacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		class: q.Class,
+		cd:    header.CheckingDisabled,
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return cacheKey{}, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return cacheKey{}, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return cacheKey{}, false
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return cacheKey{}, false
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			key.opt = true
+			key.do = rh.DNSSECAllowed()
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return cacheKey{}, false
+		}
+	}
+
+	return key, true
+}
+
+// messageSection is a section of resource records in a DNS message
+type messageSection int
+
+const (
+	sectionAnswers messageSection = iota
+	sectionAuthorities
+	sectionAdditionals
+)
+
+// packedRecord is the location of a resource record within a packed DNS message
+type packedRecord struct {
+	section    messageSection
+	rrType     dnsmessage.Type
+	ttlOffset  int
+	rdataStart int
+	rdataEnd   int
+}
+
+// walkRecords calls fn for every resource record in the given packed DNS message.
+// The message MUST NOT include the 2-byte length.
+func walkRecords(message []byte, fn func(record packedRecord)) error {
+	if len(message) < 12 {
+		return errMalformedMessage
+	}
+	questions := int(binary.BigEndian.Uint16(message[4:6]))
+	counts := []struct {
+		section messageSection
+		count   int
+	}{
+		{sectionAnswers, int(binary.BigEndian.Uint16(message[6:8]))},
+		{sectionAuthorities, int(binary.BigEndian.Uint16(message[8:10]))},
+		{sectionAdditionals, int(binary.BigEndian.Uint16(message[10:12]))},
+	}
+
+	offset := 12
+	for range questions {
+		end, err := skipName(message, offset)
+		if err != nil {
+			return err
+		}
+		offset = end + 4
+	}
+
+	for _, section := range counts {
+		for range section.count {
+			end, err := skipName(message, offset)
+			if err != nil {
+				return err
+			}
+			if end+10 > len(message) {
+				return errMalformedMessage
+			}
+			record := packedRecord{
+				section:    section.section,
+				rrType:     dnsmessage.Type(binary.BigEndian.Uint16(message[end:])),
+				ttlOffset:  end + 4,
+				rdataStart: end + 10,
+				rdataEnd:   end + 10 + int(binary.BigEndian.Uint16(message[end+8:])),
+			}
+			if record.rdataEnd > len(message) {
+				return errMalformedMessage
+			}
+			fn(record)
+			offset = record.rdataEnd
+		}
+	}
+
+	return nil
+}
+
+// recordTTLs returns the offset of the TTL of every record in the given packed DNS message, along
+// with the lowest TTL. OPT records are skipped as they don't have a TTL.
+// The message MUST NOT include the 2-byte length.
+func recordTTLs(message []byte) ([]int, uint32, error) {
+	offsets := []int{}
+	var minTTL uint32
+	err := walkRecords(message, func(record packedRecord) {
+		if record.rrType == dnsmessage.TypeOPT {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(message[record.ttlOffset:])
+		if len(offsets) == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+		offsets = append(offsets, record.ttlOffset)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return offsets, minTTL, nil
+}
+
+// setNegativeTTL sets the TTL of the SOA record in the authority section of the given negative
+// reply to the time the reply can be cached for, which is the lower of the SOA records TTL and its
+// MINIMUM field (RFC 2308 section 5), capped at maxTTL. Returns false if there is no SOA record.
+// The message MUST NOT include the 2-byte length.
+func setNegativeTTL(message []byte, maxTTL uint32) bool {
+	found := false
+	err := walkRecords(message, func(record packedRecord) {
+		if found || record.section != sectionAuthorities || record.rrType != dnsmessage.TypeSOA {
+			return
+		}
+		// MINIMUM is the last field of the SOA record
+		if record.rdataEnd-record.rdataStart < 22 {
+			return
+		}
+		ttl := min(binary.BigEndian.Uint32(message[record.ttlOffset:]), binary.BigEndian.Uint32(message[record.rdataEnd-4:]), maxTTL)
+		binary.BigEndian.PutUint32(message[record.ttlOffset:], ttl)
+		found = true
+	})
+	return err == nil && found
+}
+
+// skipName returns the offset of the byte following the domain name that starts at the given
+// offset in the packed DNS message.
+func skipName(message []byte, offset int) (int, error) {
+	for {
+		if offset >= len(message) {
+			return 0, errMalformedMessage
+		}
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			if offset+2 > len(message) {
+				return 0, errMalformedMessage
+			}
+			return offset + 2, nil
+		case length&0xc0 != 0:
+			return 0, errMalformedMessage
+		}
+		offset += 1 + length
+	}
+}
@@ -0,0 +1,179 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// cacheSnapshotVersion is incremented whenever the format of the cache snapshot changes. Snapshots
+// from other versions are ignored.
+const cacheSnapshotVersion = 2
+
+type cacheSnapshot struct {
+	Version int
+	Entries []cacheSnapshotEntry
+}
+
+type cacheSnapshotEntry struct {
+	Name    string
+	Type    uint16
+	Class   uint16
+	OPT     bool
+	DO      bool
+	CD      bool
+	Reply   []byte
+	Stored  time.Time
+	Expires time.Time
+}
+
+// Save writes every entry in the cache to the file at the given path. The file is replaced
+// atomically, so a partially written snapshot is never loaded.
+func (c *responseCache) Save(path string) (int, error) {
+	snapshot := cacheSnapshot{Version: cacheSnapshotVersion}
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		// Least recently used first, so that the order is kept when the entries are loaded
+		for element := shard.lru.Back(); element != nil; element = element.Prev() {
+			entry := element.Value.(*cacheEntry)
+			snapshot.Entries = append(snapshot.Entries, cacheSnapshotEntry{
+				Name:    entry.key.name,
+				Type:    uint16(entry.key.qtype),
+				Class:   uint16(entry.key.class),
+				OPT:     entry.key.opt,
+				DO:      entry.key.do,
+				CD:      entry.key.cd,
+				Reply:   entry.reply,
+				Stored:  entry.stored,
+				Expires: entry.expires,
+			})
+		}
+		shard.lock.Unlock()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".dnsproxy-cache-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(snapshot); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, err
+	}
+	return len(snapshot.Entries), nil
+}
+
+// Load adds the entries from the snapshot file at the given path to the cache. Entries that have
+// expired, including the serve-stale window, are skipped. The TTLs of the loaded entries count
+// down from when they were first cached, so the time the server was stopped for is accounted for.
+func (c *responseCache) Load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	snapshot := cacheSnapshot{}
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version %d", snapshot.Version)
+	}
+
+	now := time.Now()
+	loaded := 0
+	for _, s := range snapshot.Entries {
+		key := cacheKey{
+			name:  s.Name,
+			qtype: dnsmessage.Type(s.Type),
+			class: dnsmessage.Class(s.Class),
+			opt:   s.OPT,
+			do:    s.DO,
+			cd:    s.CD,
+		}
+		shard := c.shardFor(key)
+		if len(s.Reply) < 14 || !now.Before(s.Expires.Add(shard.options.staleFor)) {
+			continue
+		}
+
+		offsets, _, err := recordTTLs(s.Reply[2:])
+		if err != nil {
+			continue
+		}
+		for i := range offsets {
+			offsets[i] += 2
+		}
+		shard.set(&cacheEntry{
+			key:        key,
+			reply:      s.Reply,
+			ttlOffsets: offsets,
+			stored:     s.Stored,
+			expires:    s.Expires,
+		})
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+func loadCache() {
+	loaded, err := dnsCache.Load(serverConfig.CachePersistPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.PError("Error loading response cache", map[string]any{
+				"path":  serverConfig.CachePersistPath,
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+	log.PInfo("Loaded response cache", map[string]any{
+		"path":    serverConfig.CachePersistPath,
+		"entries": loaded,
+	})
+}
+
+func saveCache() {
+	saved, err := dnsCache.Save(serverConfig.CachePersistPath)
+	if err != nil {
+		log.PError("Error saving response cache", map[string]any{
+			"path":  serverConfig.CachePersistPath,
+			"error": err.Error(),
+		})
+		return
+	}
+	log.PInfo("Saved response cache", map[string]any{
+		"path":    serverConfig.CachePersistPath,
+		"entries": saved,
+	})
+}
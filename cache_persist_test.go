@@ -0,0 +1,70 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResponseCachePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+	options := cacheOptions{maxEntries: 100, maxBytes: 1 << 20}
+
+	cache := newResponseCache(options)
+	query := buildTestQuery("example.com.", false)
+	key, _ := cacheKeyFor(query)
+	cache.Set(key, buildTestReply("example.com.", 300))
+
+	// An entry that was cached a while ago and has since expired
+	expiredKey := cacheKey{name: "expired.example.com.", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	cache.shardFor(expiredKey).set(newCacheEntry(expiredKey, buildTestReply(expiredKey.name, 1), time.Now().Add(-time.Minute)))
+
+	saved, err := cache.Save(path)
+	if err != nil {
+		t.Fatalf("Error saving cache: %s", err.Error())
+	}
+	if saved != 2 {
+		t.Errorf("Unexpected number of entries saved %d", saved)
+	}
+
+	loadedCache := newResponseCache(options)
+	loaded, err := loadedCache.Load(path)
+	if err != nil {
+		t.Fatalf("Error loading cache: %s", err.Error())
+	}
+	if loaded != 1 {
+		t.Errorf("Unexpected number of entries loaded %d", loaded)
+	}
+
+	replyData, state := loadedCache.shardFor(key).get(key, query, time.Now().Add(100*time.Second))
+	if state != cacheHit {
+		t.Fatalf("Entry not loaded from snapshot")
+	}
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(replyData[2:]); err != nil {
+		t.Fatalf("Error parsing loaded reply: %s", err.Error())
+	}
+	if ttl := reply.Answers[0].Header.TTL; ttl != 200 {
+		t.Errorf("TTL of loaded reply not adjusted for elapsed time. Expected 200 got %d", ttl)
+	}
+}
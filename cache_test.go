@@ -0,0 +1,280 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// buildTestReply returns a reply to buildTestQuery with a single A record with the given TTL
+func buildTestReply(name string, ttl uint32) []byte {
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: 1234, Response: true, RecursionDesired: true, RecursionAvailable: true})
+	builder.EnableCompression()
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	builder.StartAnswers()
+	builder.AResource(dnsmessage.ResourceHeader{
+		Name:  dnsmessage.MustNewName(name),
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+	}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	message, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+	binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+	return message
+}
+
+func TestCacheKey(t *testing.T) {
+	plain, ok := cacheKeyFor(buildTestQuery("Example.COM.", false))
+	if !ok {
+		t.Fatalf("Query not cacheable")
+	}
+	if plain.name != "example.com." || plain.qtype != dnsmessage.TypeA || plain.class != dnsmessage.ClassINET {
+		t.Errorf("Unexpected cache key %+v", plain)
+	}
+
+	withOPT, ok := cacheKeyFor(buildTestQuery("example.com.", true))
+	if !ok {
+		t.Fatalf("Query not cacheable")
+	}
+	if withOPT == plain || !withOPT.opt || withOPT.do {
+		t.Errorf("Query with an OPT record has the same cache key as one without")
+	}
+
+	if _, ok := cacheKeyFor(buildTestReply("example.com.", 60)); ok {
+		t.Errorf("Reply was cacheable as a query")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	cache := newResponseCache(cacheOptions{maxEntries: 100, maxBytes: 1 << 20})
+	query := buildTestQuery("example.com.", false)
+	key, _ := cacheKeyFor(query)
+
+	if reply, _ := cache.Get(key, query); reply != nil {
+		t.Fatalf("Unexpected reply from empty cache")
+	}
+	cache.Set(key, buildTestReply("example.com.", 300))
+
+	// Another client asks with a different ID and case
+	query = buildTestQuery("EXAMPLE.com.", false)
+	binary.BigEndian.PutUint16(query[2:], 4321)
+	shard := cache.shardFor(key)
+	replyData, state := shard.get(key, query, time.Now().Add(100*time.Second))
+	if state != cacheHit {
+		t.Fatalf("No cached reply")
+	}
+
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(replyData[2:]); err != nil {
+		t.Fatalf("Error parsing cached reply: %s", err.Error())
+	}
+	if reply.ID != 4321 {
+		t.Errorf("Message ID not rewritten. Got %d", reply.ID)
+	}
+	if name := reply.Questions[0].Name.String(); name != "EXAMPLE.com." {
+		t.Errorf("Question name case not copied. Got %s", name)
+	}
+	if ttl := reply.Answers[0].Header.TTL; ttl != 200 {
+		t.Errorf("TTL not decremented. Expected 200 got %d", ttl)
+	}
+
+	// Expired entries are removed
+	if reply, _ := shard.get(key, query, time.Now().Add(301*time.Second)); reply != nil {
+		t.Errorf("Expired reply returned from cache")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Expired reply not removed from cache")
+	}
+
+	// Replies with a TTL of 0 are never cached
+	cache.Set(key, buildTestReply("example.com.", 0))
+	if cache.Len() != 0 {
+		t.Errorf("Reply with a TTL of 0 was cached")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newResponseCache(cacheOptions{maxEntries: cacheShardCount * 2, maxBytes: 1 << 20})
+	shard := cache.shards[0]
+
+	keys := []cacheKey{}
+	for i := range 3 {
+		key := cacheKey{name: fmt.Sprintf("%d.example.com.", i), qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+		keys = append(keys, key)
+		shard.set(newCacheEntry(key, buildTestReply(key.name, 60), time.Now()))
+		if i == 1 {
+			// Use the first entry so that the second is the least recently used
+			shard.get(keys[0], buildTestQuery(keys[0].name, false), time.Now())
+		}
+	}
+
+	if _, ok := shard.entries[keys[1]]; ok || len(shard.entries) != 2 {
+		t.Errorf("Least recently used entry was not evicted")
+	}
+
+	// The memory budget is also enforced
+	entry := newCacheEntry(keys[0], buildTestReply(keys[0].name, 60), time.Now())
+	shard.maxBytes = entry.size()
+	shard.set(entry)
+	if len(shard.entries) != 1 || shard.bytes != entry.size() {
+		t.Errorf("Memory budget not enforced, %d entries using %d bytes", len(shard.entries), shard.bytes)
+	}
+}
+
+func TestResponseCacheLimit(t *testing.T) {
+	cache := newResponseCache(cacheOptions{maxEntries: cacheShardCount + 1, maxBytes: 1 << 20})
+	for i := range 200 {
+		name := fmt.Sprintf("%d.example.com.", i)
+		key, _ := cacheKeyFor(buildTestQuery(name, false))
+		cache.Set(key, buildTestReply(name, 60))
+	}
+	if n := cache.Len(); n > cacheShardCount+1 {
+		t.Errorf("Cache holds %d entries, more than its limit of %d", n, cacheShardCount+1)
+	}
+}
+
+func TestResponseCacheServeStale(t *testing.T) {
+	cache := newResponseCache(cacheOptions{maxEntries: 100, maxBytes: 1 << 20, staleFor: time.Hour, staleTTL: 30})
+	query := buildTestQuery("example.com.", false)
+	key, _ := cacheKeyFor(query)
+	cache.Set(key, buildTestReply("example.com.", 60))
+	shard := cache.shardFor(key)
+
+	replyData, state := shard.get(key, query, time.Now().Add(30*time.Minute))
+	if state != cacheStale {
+		t.Fatalf("No stale reply within the serve-stale window")
+	}
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(replyData[2:]); err != nil {
+		t.Fatalf("Error parsing stale reply: %s", err.Error())
+	}
+	if ttl := reply.Answers[0].Header.TTL; ttl != 30 {
+		t.Errorf("Unexpected TTL in stale reply %d", ttl)
+	}
+
+	if reply, _ := shard.get(key, query, time.Now().Add(2*time.Hour)); reply != nil {
+		t.Errorf("Stale reply returned after the serve-stale window")
+	}
+}
+
+func TestResponseCachePrefetch(t *testing.T) {
+	cache := newResponseCache(cacheOptions{maxEntries: 100, maxBytes: 1 << 20, prefetchFraction: 0.1, prefetchMinHits: 2})
+	query := buildTestQuery("example.com.", false)
+	key, _ := cacheKeyFor(query)
+	cache.Set(key, buildTestReply("example.com.", 100))
+	shard := cache.shardFor(key)
+
+	nearExpiry := time.Now().Add(95 * time.Second)
+	for i, expected := range []cacheState{cacheHit, cachePrefetch, cacheHit} {
+		now := nearExpiry
+		if i == 0 {
+			now = time.Now()
+		}
+		if _, state := shard.get(key, query, now); state != expected {
+			t.Errorf("Unexpected cache state on hit %d. Expected %d got %d", i+1, expected, state)
+		}
+	}
+
+	// Refreshing the entry resets the hit count
+	cache.Set(key, buildTestReply("example.com.", 100))
+	if _, state := shard.get(key, query, nearExpiry); state != cacheHit {
+		t.Errorf("Refreshed entry was prefetched before reaching the minimum hits")
+	}
+}
+
+// buildTestNegativeReply returns an empty reply to buildTestQuery with the given response code. If
+// soaTTL isn't 0 then the authority section has an SOA record with that TTL and the given minimum.
+func buildTestNegativeReply(name string, rcode dnsmessage.RCode, soaTTL, minimum uint32) []byte {
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: 1234, Response: true, RCode: rcode})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	builder.StartAuthorities()
+	if soaTTL > 0 {
+		builder.SOAResource(dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Class: dnsmessage.ClassINET,
+			TTL:   soaTTL,
+		}, dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns.example.com."),
+			MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  minimum,
+		})
+	}
+	message, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+	binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+	return message
+}
+
+func TestNegativeCache(t *testing.T) {
+	key := cacheKey{name: "missing.example.com.", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	now := time.Now()
+
+	// NXDOMAIN is cached for the lower of the SOA TTL and minimum
+	entry := newCacheEntry(key, buildTestNegativeReply(key.name, dnsmessage.RCodeNameError, 600, 60), now)
+	if entry == nil {
+		t.Fatalf("NXDOMAIN reply not cached")
+	}
+	if ttl := entry.expires.Sub(now); ttl != 60*time.Second {
+		t.Errorf("Unexpected negative TTL %s", ttl)
+	}
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(entry.replyFor(buildTestQuery(key.name, false), now)[2:]); err != nil {
+		t.Fatalf("Error parsing cached reply: %s", err.Error())
+	}
+	if ttl := reply.Authorities[0].Header.TTL; ttl != 60 {
+		t.Errorf("SOA TTL not set to negative TTL. Got %d", ttl)
+	}
+
+	// NODATA is capped at the maximum negative TTL
+	entry = newCacheEntry(key, buildTestNegativeReply(key.name, dnsmessage.RCodeSuccess, 86400, 86400), now)
+	if entry == nil {
+		t.Fatalf("NODATA reply not cached")
+	}
+	if ttl := entry.expires.Sub(now); ttl != time.Duration(serverConfig.CacheNegativeMaxTTL)*time.Second {
+		t.Errorf("Negative TTL not capped. Got %s", ttl)
+	}
+
+	// Negative replies without an SOA record are not cached
+	if newCacheEntry(key, buildTestNegativeReply(key.name, dnsmessage.RCodeNameError, 0, 0), now) != nil {
+		t.Errorf("NXDOMAIN reply without SOA was cached")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"dnsproxy/monitoring"
+	"sync"
+)
+
+// inflightQueries are the queries currently being sent to upstream servers
+var inflightQueries = &queryCollapser{
+	lock:    &sync.Mutex{},
+	queries: map[cacheKey]*inflightQuery{},
+}
+
+type inflightQuery struct {
+	done     chan struct{}
+	reply    []byte
+	upstream *upstream
+	err      error
+}
+
+// queryCollapser ensures only one query for the same question is sent to the upstream servers at
+// a time. Queries for a question that is already being sent wait for that query instead.
+type queryCollapser struct {
+	lock    *sync.Mutex
+	queries map[cacheKey]*inflightQuery
+}
+
+// Do calls exchange with the given DNS message, unless a query for the same question is already in
+// flight, in which case it waits for and returns the reply to that query instead. Shared replies
+// are copied and given the message ID and question name from the message.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func (c *queryCollapser) Do(key cacheKey, message []byte, exchange func() ([]byte, *upstream, error)) ([]byte, *upstream, error) {
+	c.lock.Lock()
+	if q, ok := c.queries[key]; ok {
+		c.lock.Unlock()
+		monitoring.RecordQueryCollapsed()
+		<-q.done
+		if q.err != nil {
+			return nil, nil, q.err
+		}
+		return copyReplyFor(q.reply, message), q.upstream, nil
+	}
+	q := &inflightQuery{done: make(chan struct{})}
+	c.queries[key] = q
+	c.lock.Unlock()
+
+	q.reply, q.upstream, q.err = exchange()
+
+	c.lock.Lock()
+	delete(c.queries, key)
+	c.lock.Unlock()
+	close(q.done)
+
+	return q.reply, q.upstream, q.err
+}
+
+// resolve sends the given DNS message to the upstream servers for it, sharing the reply with any
+// identical queries that are sent at the same time.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func resolve(message []byte) ([]byte, *upstream, error) {
+	exchange := func() ([]byte, *upstream, error) {
+		return upstreamGroupFor(message).Exchange(context.Background(), message)
+	}
+
+	if !serverConfig.CollapseQueries {
+		return exchange()
+	}
+	key, ok := cacheKeyFor(message)
+	if !ok {
+		return exchange()
+	}
+	return inflightQueries.Do(key, message, exchange)
+}
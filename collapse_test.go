@@ -0,0 +1,69 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCollapser(t *testing.T) {
+	collapser := &queryCollapser{lock: &sync.Mutex{}, queries: map[cacheKey]*inflightQuery{}}
+	release := make(chan struct{})
+	exchanges := &atomic.Int32{}
+	exchange := func() ([]byte, *upstream, error) {
+		exchanges.Add(1)
+		<-release
+		return buildTestReply("example.com.", 60), &upstream{addr: "test"}, nil
+	}
+
+	key, _ := cacheKeyFor(buildTestQuery("example.com.", false))
+	wg := &sync.WaitGroup{}
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			message := buildTestQuery("example.com.", false)
+			binary.BigEndian.PutUint16(message[2:], uint16(i))
+			reply, _, err := collapser.Do(key, message, exchange)
+			if err != nil {
+				t.Errorf("Error exchanging message: %s", err.Error())
+				return
+			}
+			// The first query gets the reply as-is from the upstream
+			if id := binary.BigEndian.Uint16(reply[2:]); id != uint16(i) && id != 1234 {
+				t.Errorf("Shared reply has the wrong message ID %d", id)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := exchanges.Load(); n != 1 {
+		t.Errorf("Expected 1 upstream query, got %d", n)
+	}
+	if len(collapser.queries) != 0 {
+		t.Errorf("Finished query was not removed")
+	}
+}
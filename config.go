@@ -23,11 +23,13 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "embed"
 )
@@ -35,6 +37,37 @@ import (
 //go:embed dnsproxy.conf
 var DefaultConfig string
 
+type tUpstreamConfig struct {
+	Name     string
+	Protocol string
+	Addr     string
+	Weight   int
+	SNI      string
+	CAPath   string
+	Pins     []string
+}
+
+type tForwardZoneConfig struct {
+	Zone    string
+	Servers []tUpstreamConfig
+}
+
+type tZoneFileConfig struct {
+	Zone string
+	Path string
+}
+
+type tACLRule struct {
+	Allow     bool
+	Protocols []string
+	Networks  []netip.Prefix
+}
+
+type tRateLimit struct {
+	QPS   float64
+	Burst float64
+}
+
 type tServerConfig struct {
 	CertPath            string
 	KeyPath             string
@@ -42,7 +75,7 @@ type tServerConfig struct {
 	LogPath             string
 	RequestsLogPath     *string
 	CompressRotatedLogs bool
-	DNSServerAddr       string
+	DNSServers          []tUpstreamConfig
 	HTTPSPort           uint16
 	HTTPPort            uint16
 	TLSPort             uint16
@@ -52,6 +85,58 @@ type tServerConfig struct {
 	ControlZone         *string
 	WellKnownPath       *string
 	ZabbixHost          *string
+
+	UpstreamPoolSize            int
+	UpstreamIdleTimeout         time.Duration
+	UpstreamReconnects          int
+	UpstreamHealthCheckInterval time.Duration
+	UpstreamHealthCheckName     string
+	UpstreamMaxFails            int
+	UpstreamStrategy            string
+	UpstreamUDPBufferSize       uint16
+	UpstreamDialTimeout         time.Duration
+	UpstreamReadTimeout         time.Duration
+	UpstreamWriteTimeout        time.Duration
+	UpstreamQueryTimeout        time.Duration
+	UpstreamRetries             int
+	UpstreamRetryServfail       bool
+	UpstreamRaceCount           int
+	UpstreamRaceDelay           time.Duration
+	ExtendedDNSErrors           bool
+	CacheMaxEntries             int
+	CacheMaxMemory              int64
+	CacheServeStale             time.Duration
+	CacheStaleTTL               uint32
+	CacheClientResponseTimeout  time.Duration
+	CachePrefetchFraction       float64
+	CachePrefetchMinHits        int
+	CacheNegativeMaxTTL         uint32
+	CachePersistPath            string
+	CollapseQueries             bool
+	BlocklistPaths              []string
+	BlocklistResponse           string
+	BlocklistAddrs              []netip.Addr
+	BlocklistTTL                uint32
+	AllowlistPaths              []string
+	BlocklistAutoReload         bool
+	ACLRules                    []tACLRule
+	ACLDenyAction               string
+	RateLimits                  map[string]tRateLimit
+	RateLimitAction             string
+	RateLimitIPv4Prefix         int
+	RateLimitIPv6Prefix         int
+	RateLimitLogEvery           int
+	RRLResponsesPerSecond       float64
+	AnyQueryResponse            string
+	RebindProtection            string
+	RebindAllowedDomains        []string
+	LocalRecords                []string
+	HostsPath                   string
+	LocalTTL                    uint32
+	LocalAutoPTR                bool
+	ForwardZones                []tForwardZoneConfig
+	RPZZones                    []tZoneFileConfig
+	LocalZones                  []tZoneFileConfig
 }
 
 func (c tServerConfig) Validate() (errors []string) {
@@ -77,8 +162,159 @@ func (c tServerConfig) Validate() (errors []string) {
 		errors = append(errors, "invalid requests log path")
 	}
 
-	if _, _, err := net.SplitHostPort(c.DNSServerAddr); err != nil {
-		errors = append(errors, fmt.Sprintf("invalid dns server address: %s", err.Error()))
+	if len(c.DNSServers) == 0 {
+		errors = append(errors, "at least one dns server address is required")
+	}
+	for _, server := range c.DNSServers {
+		errors = append(errors, server.Validate()...)
+	}
+
+	for _, zone := range c.ForwardZones {
+		if !strings.HasSuffix(zone.Zone, ".") {
+			errors = append(errors, fmt.Sprintf("forward_zone %s must end with a period", zone.Zone))
+		}
+		if len(zone.Servers) == 0 {
+			errors = append(errors, fmt.Sprintf("forward_zone %s requires at least one dns server address", zone.Zone))
+		}
+		for _, server := range zone.Servers {
+			errors = append(errors, server.Validate()...)
+		}
+	}
+
+	if len(c.AllowlistPaths) > 0 && len(c.BlocklistPaths) == 0 {
+		errors = append(errors, "allowlist_paths requires blocklist_paths")
+	}
+
+	for _, zone := range c.RPZZones {
+		if !strings.HasSuffix(zone.Zone, ".") {
+			errors = append(errors, fmt.Sprintf("rpz_zone %s must end with a period", zone.Zone))
+		}
+		if zone.Path == "" {
+			errors = append(errors, fmt.Sprintf("rpz_zone %s requires a zone file path", zone.Zone))
+		}
+	}
+
+	for _, zone := range c.LocalZones {
+		if !strings.HasSuffix(zone.Zone, ".") {
+			errors = append(errors, fmt.Sprintf("local_zone %s must end with a period", zone.Zone))
+		}
+		if zone.Path == "" {
+			errors = append(errors, fmt.Sprintf("local_zone %s requires a zone file path", zone.Zone))
+		}
+	}
+
+	for _, line := range c.LocalRecords {
+		if _, err := parseZoneRecord(line, ".", c.LocalTTL); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid local_record value: %s: %s", line, err.Error()))
+		}
+	}
+
+	if c.UpstreamPoolSize < 1 {
+		errors = append(errors, "upstream_pool_size must be at least 1")
+	}
+
+	if c.UpstreamIdleTimeout <= 0 {
+		errors = append(errors, "upstream_idle_timeout must be greater than 0")
+	}
+
+	if c.UpstreamReconnects < 0 {
+		errors = append(errors, "upstream_reconnect_attempts must not be negative")
+	}
+
+	if c.UpstreamHealthCheckInterval < 0 {
+		errors = append(errors, "upstream_health_check_interval must not be negative")
+	}
+
+	if !strings.HasSuffix(c.UpstreamHealthCheckName, ".") {
+		errors = append(errors, "upstream_health_check_name must end with a period")
+	}
+
+	if c.UpstreamMaxFails < 1 {
+		errors = append(errors, "upstream_max_fails must be at least 1")
+	}
+
+	if !slices.Contains(upstreamStrategies, c.UpstreamStrategy) {
+		errors = append(errors, fmt.Sprintf("invalid upstream strategy %s", c.UpstreamStrategy))
+	}
+
+	if c.UpstreamUDPBufferSize < 512 {
+		errors = append(errors, "upstream_udp_buffer_size must be at least 512")
+	}
+
+	if c.UpstreamDialTimeout <= 0 {
+		errors = append(errors, "upstream_dial_timeout must be greater than 0")
+	}
+
+	if c.UpstreamReadTimeout <= 0 {
+		errors = append(errors, "upstream_read_timeout must be greater than 0")
+	}
+
+	if c.UpstreamWriteTimeout <= 0 {
+		errors = append(errors, "upstream_write_timeout must be greater than 0")
+	}
+
+	if c.UpstreamQueryTimeout <= 0 {
+		errors = append(errors, "upstream_query_timeout must be greater than 0")
+	}
+
+	if c.UpstreamRetries < 0 {
+		errors = append(errors, "upstream_retries must not be negative")
+	}
+
+	if c.UpstreamRaceCount < 0 {
+		errors = append(errors, "upstream_race_count must not be negative")
+	}
+
+	if c.UpstreamRaceDelay < 0 {
+		errors = append(errors, "upstream_race_delay must not be negative")
+	}
+
+	if c.RateLimitIPv4Prefix < 0 || c.RateLimitIPv4Prefix > 32 {
+		errors = append(errors, "ratelimit_ipv4_prefix must be between 0 and 32")
+	}
+
+	if c.RateLimitIPv6Prefix < 0 || c.RateLimitIPv6Prefix > 128 {
+		errors = append(errors, "ratelimit_ipv6_prefix must be between 0 and 128")
+	}
+
+	if c.RateLimitLogEvery < 1 {
+		errors = append(errors, "ratelimit_log_every must be at least 1")
+	}
+
+	if c.RRLResponsesPerSecond < 0 {
+		errors = append(errors, "rrl_responses_per_second must not be negative")
+	}
+
+	if c.CacheMaxEntries < 0 {
+		errors = append(errors, "cache_max_entries must not be negative")
+	}
+
+	if c.CacheMaxEntries > 0 && c.CacheMaxEntries < cacheShardCount {
+		errors = append(errors, fmt.Sprintf("cache_max_entries must be 0 or at least %d", cacheShardCount))
+	}
+
+	if c.CacheMaxEntries > 0 && c.CacheMaxMemory <= 0 {
+		errors = append(errors, "cache_max_memory must be greater than 0")
+	}
+
+	if c.CacheServeStale < 0 {
+		errors = append(errors, "cache_serve_stale must not be negative")
+	}
+
+	if c.CacheServeStale > 0 && c.CacheStaleTTL == 0 {
+		errors = append(errors, "cache_stale_ttl must be greater than 0")
+	}
+
+	if c.CacheServeStale > 0 && c.CacheClientResponseTimeout <= 0 {
+		errors = append(errors, "cache_client_response_timeout must be greater than 0")
+	}
+
+	if c.CachePrefetchFraction < 0 || c.CachePrefetchFraction >= 1 {
+		errors = append(errors, "cache_prefetch_fraction must be at least 0 and less than 1")
+	}
+
+	if c.CachePrefetchMinHits < 1 {
+		errors = append(errors, "cache_prefetch_min_hits must be at least 1")
 	}
 
 	if c.HTTPSPort+c.TLSPort+c.QuicPort == 0 {
@@ -113,6 +349,29 @@ func (c tServerConfig) Validate() (errors []string) {
 	return errors
 }
 
+func (s tUpstreamConfig) Validate() (errors []string) {
+	errors = []string{}
+
+	if !slices.Contains(upstreamProtocols, s.Protocol) {
+		errors = append(errors, fmt.Sprintf("unsupported protocol for dns server %s", s.Name))
+	}
+	if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid dns server address: %s", err.Error()))
+	}
+	if s.Weight < 1 {
+		errors = append(errors, fmt.Sprintf("invalid weight for dns server %s: must be at least 1", s.Name))
+	}
+	if slices.Contains(upstreamEncryptedProtocols, s.Protocol) {
+		if _, err := newUpstreamTLSConfig(s, nil); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid tls options for dns server %s: %s", s.Name, err.Error()))
+		}
+	} else if s.SNI != "" || s.CAPath != "" || len(s.Pins) > 0 {
+		errors = append(errors, fmt.Sprintf("tls options are not supported for dns server %s", s.Name))
+	}
+
+	return errors
+}
+
 func TestConfig(configPath string) {
 	mustLoadConfig(configPath)
 }
@@ -124,7 +383,44 @@ func loadConfig(configPath string) (*tServerConfig, []string) {
 	}
 	defer configFile.Close()
 
-	config := tServerConfig{}
+	config := tServerConfig{
+		UpstreamPoolSize:            4,
+		UpstreamIdleTimeout:         30 * time.Second,
+		UpstreamReconnects:          1,
+		UpstreamHealthCheckInterval: 10 * time.Second,
+		UpstreamHealthCheckName:     ".",
+		UpstreamMaxFails:            3,
+		UpstreamStrategy:            strategyPriority,
+		UpstreamUDPBufferSize:       1232,
+		UpstreamDialTimeout:         5 * time.Second,
+		UpstreamReadTimeout:         5 * time.Second,
+		UpstreamWriteTimeout:        5 * time.Second,
+		UpstreamQueryTimeout:        10 * time.Second,
+		UpstreamRetries:             2,
+		UpstreamRetryServfail:       true,
+		ExtendedDNSErrors:           true,
+		CacheMaxEntries:             10000,
+		CacheMaxMemory:              64 << 20,
+		CacheStaleTTL:               30,
+		CacheClientResponseTimeout:  1800 * time.Millisecond,
+		CachePrefetchFraction:       0.1,
+		CachePrefetchMinHits:        3,
+		CacheNegativeMaxTTL:         3600,
+		CollapseQueries:             true,
+		BlocklistResponse:           blockResponseNXDomain,
+		BlocklistTTL:                60,
+		BlocklistAutoReload:         true,
+		ACLDenyAction:               aclDenyRefused,
+		RateLimits:                  map[string]tRateLimit{},
+		RateLimitAction:             rateLimitRefused,
+		RateLimitIPv4Prefix:         32,
+		RateLimitIPv6Prefix:         56,
+		RateLimitLogEvery:           100,
+		AnyQueryResponse:            anyResponseForward,
+		RebindProtection:            rebindProtectionOff,
+		LocalTTL:                    300,
+		LocalAutoPTR:                true,
+	}
 
 	errors := []string{}
 
@@ -156,7 +452,276 @@ func loadConfig(configPath string) (*tServerConfig, []string) {
 		case "compress_rotated_logs":
 			config.CompressRotatedLogs = strings.EqualFold(value, "true") || strings.EqualFold(value, "on") || strings.EqualFold(value, "yes")
 		case "dns_server_addr":
-			config.DNSServerAddr = value
+			servers, err := parseUpstreamList(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid dns_server_addr value: %s", err.Error()))
+			}
+			config.DNSServers = servers
+		case "forward_zone":
+			zone, list, _ := strings.Cut(value, " ")
+			servers, err := parseUpstreamList(list)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid forward_zone value: %s", err.Error()))
+			}
+			config.ForwardZones = append(config.ForwardZones, tForwardZoneConfig{
+				Zone:    zone,
+				Servers: servers,
+			})
+		case "upstream_pool_size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_pool_size value: %s", value))
+			}
+			config.UpstreamPoolSize = size
+		case "upstream_idle_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_idle_timeout value: %s", value))
+			}
+			config.UpstreamIdleTimeout = timeout
+		case "upstream_reconnect_attempts":
+			attempts, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_reconnect_attempts value: %s", value))
+			}
+			config.UpstreamReconnects = attempts
+		case "upstream_health_check_interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_health_check_interval value: %s", value))
+			}
+			config.UpstreamHealthCheckInterval = interval
+		case "upstream_health_check_name":
+			config.UpstreamHealthCheckName = value
+		case "upstream_max_fails":
+			fails, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_max_fails value: %s", value))
+			}
+			config.UpstreamMaxFails = fails
+		case "upstream_strategy":
+			config.UpstreamStrategy = value
+		case "upstream_udp_buffer_size":
+			size, err := parseUint16(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_udp_buffer_size value: %s", value))
+			}
+			config.UpstreamUDPBufferSize = size
+		case "upstream_dial_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_dial_timeout value: %s", value))
+			}
+			config.UpstreamDialTimeout = timeout
+		case "upstream_read_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_read_timeout value: %s", value))
+			}
+			config.UpstreamReadTimeout = timeout
+		case "upstream_write_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_write_timeout value: %s", value))
+			}
+			config.UpstreamWriteTimeout = timeout
+		case "upstream_query_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_query_timeout value: %s", value))
+			}
+			config.UpstreamQueryTimeout = timeout
+		case "upstream_retries":
+			retries, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_retries value: %s", value))
+			}
+			config.UpstreamRetries = retries
+		case "upstream_retry_servfail":
+			config.UpstreamRetryServfail = strings.EqualFold(value, "true") || strings.EqualFold(value, "on") || strings.EqualFold(value, "yes")
+		case "upstream_race_count":
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_race_count value: %s", value))
+			}
+			config.UpstreamRaceCount = count
+		case "upstream_race_delay":
+			delay, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid upstream_race_delay value: %s", value))
+			}
+			config.UpstreamRaceDelay = delay
+		case "extended_dns_errors":
+			config.ExtendedDNSErrors = strings.EqualFold(value, "true") || strings.EqualFold(value, "on") || strings.EqualFold(value, "yes")
+		case "cache_max_entries":
+			entries, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_max_entries value: %s", value))
+			}
+			config.CacheMaxEntries = entries
+		case "cache_max_memory":
+			size, err := parseByteSize(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_max_memory value: %s", value))
+			}
+			config.CacheMaxMemory = size
+		case "cache_serve_stale":
+			window, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_serve_stale value: %s", value))
+			}
+			config.CacheServeStale = window
+		case "cache_stale_ttl":
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_stale_ttl value: %s", value))
+			}
+			config.CacheStaleTTL = uint32(ttl)
+		case "cache_client_response_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_client_response_timeout value: %s", value))
+			}
+			config.CacheClientResponseTimeout = timeout
+		case "cache_prefetch_fraction":
+			fraction, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_prefetch_fraction value: %s", value))
+			}
+			config.CachePrefetchFraction = fraction
+		case "cache_prefetch_min_hits":
+			hits, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_prefetch_min_hits value: %s", value))
+			}
+			config.CachePrefetchMinHits = hits
+		case "cache_negative_max_ttl":
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid cache_negative_max_ttl value: %s", value))
+			}
+			config.CacheNegativeMaxTTL = uint32(ttl)
+		case "cache_persist_path":
+			config.CachePersistPath = value
+		case "collapse_queries":
+			config.CollapseQueries = strings.EqualFold(value, "true") || strings.EqualFold(value, "on") || strings.EqualFold(value, "yes")
+		case "blocklist_paths":
+			config.BlocklistPaths = parseList(value)
+		case "blocklist_response":
+			response := strings.ToLower(value)
+			switch response {
+			case blockResponseNXDomain, blockResponseRefused, blockResponseNull:
+				config.BlocklistResponse = response
+			default:
+				addrs, err := parseAddrList(value)
+				if err != nil {
+					errors = append(errors, fmt.Sprintf("invalid blocklist_response value: %s", value))
+				}
+				config.BlocklistResponse = blockResponseCustom
+				config.BlocklistAddrs = addrs
+			}
+		case "blocklist_ttl":
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid blocklist_ttl value: %s", value))
+			}
+			config.BlocklistTTL = uint32(ttl)
+		case "allowlist_paths":
+			config.AllowlistPaths = parseList(value)
+		case "blocklist_auto_reload":
+			config.BlocklistAutoReload = strings.EqualFold(value, "true") || strings.EqualFold(value, "on") || strings.EqualFold(value, "yes")
+		case "acl_rule":
+			rule, err := parseACLRule(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid acl_rule value: %s", err.Error()))
+			}
+			config.ACLRules = append(config.ACLRules, rule)
+		case "acl_deny_action":
+			switch action := strings.ToLower(value); action {
+			case aclDenyRefused, aclDenyClose:
+				config.ACLDenyAction = action
+			default:
+				errors = append(errors, fmt.Sprintf("invalid acl_deny_action value: %s", value))
+			}
+		case "ratelimit":
+			protocols, limit, err := parseRateLimit(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid ratelimit value: %s", err.Error()))
+			}
+			for _, proto := range protocols {
+				config.RateLimits[proto] = limit
+			}
+		case "ratelimit_action":
+			switch action := strings.ToLower(value); action {
+			case rateLimitRefused, rateLimitTruncate, rateLimitDrop:
+				config.RateLimitAction = action
+			default:
+				errors = append(errors, fmt.Sprintf("invalid ratelimit_action value: %s", value))
+			}
+		case "ratelimit_ipv4_prefix":
+			bits, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid ratelimit_ipv4_prefix value: %s", value))
+			}
+			config.RateLimitIPv4Prefix = bits
+		case "ratelimit_ipv6_prefix":
+			bits, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid ratelimit_ipv6_prefix value: %s", value))
+			}
+			config.RateLimitIPv6Prefix = bits
+		case "ratelimit_log_every":
+			every, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid ratelimit_log_every value: %s", value))
+			}
+			config.RateLimitLogEvery = every
+		case "rrl_responses_per_second":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid rrl_responses_per_second value: %s", value))
+			}
+			config.RRLResponsesPerSecond = rate
+		case "rebind_protection":
+			switch protection := strings.ToLower(value); protection {
+			case rebindProtectionOff, rebindProtectionStrip, rebindProtectionRefuse:
+				config.RebindProtection = protection
+			default:
+				errors = append(errors, fmt.Sprintf("invalid rebind_protection value: %s", value))
+			}
+		case "rebind_allowed_domains":
+			config.RebindAllowedDomains = parseList(value)
+		case "local_record":
+			config.LocalRecords = append(config.LocalRecords, value)
+		case "hosts_path":
+			config.HostsPath = value
+		case "local_ttl":
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("invalid local_ttl value: %s", value))
+			}
+			config.LocalTTL = uint32(ttl)
+		case "local_auto_ptr":
+			config.LocalAutoPTR = strings.EqualFold(value, "true") || strings.EqualFold(value, "on") || strings.EqualFold(value, "yes")
+		case "any_query_response":
+			switch response := strings.ToLower(value); response {
+			case anyResponseHINFO, anyResponseNotImp, anyResponseForward:
+				config.AnyQueryResponse = response
+			default:
+				errors = append(errors, fmt.Sprintf("invalid any_query_response value: %s", value))
+			}
+		case "rpz_zone":
+			zone, path, _ := strings.Cut(value, " ")
+			config.RPZZones = append(config.RPZZones, tZoneFileConfig{
+				Zone: zone,
+				Path: strings.TrimSpace(path),
+			})
+		case "local_zone":
+			zone, path, _ := strings.Cut(value, " ")
+			config.LocalZones = append(config.LocalZones, tZoneFileConfig{
+				Zone: zone,
+				Path: strings.TrimSpace(path),
+			})
 		case "https_port":
 			httpsport, err := parseUint16(value)
 			if err != nil {
@@ -230,3 +795,119 @@ func parseUint16(str string) (uint16, error) {
 	v, err := strconv.ParseUint(str, 10, 16)
 	return uint16(v), err
 }
+
+// parseByteSize parses a number of bytes, optionally followed by a K, M, or G suffix
+func parseByteSize(str string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		str = str[:len(str)-1]
+	}
+
+	v, err := strconv.ParseInt(str, 10, 64)
+	return v * multiplier, err
+}
+
+// parseAddrList parses a comma separated list of IP addresses
+func parseAddrList(str string) ([]netip.Addr, error) {
+	addrs := []netip.Addr{}
+	for _, entry := range parseList(str) {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// parseUpstreamList parses a comma separated list of upstream server entries
+func parseUpstreamList(str string) ([]tUpstreamConfig, error) {
+	servers := []tUpstreamConfig{}
+	for _, entry := range parseList(str) {
+		server, err := parseUpstreamConfig(entry)
+		if err != nil {
+			return servers, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// parseUpstreamConfig parses a single upstream server entry. Entries are an address, optionally
+// prefixed with the protocol, followed by optional space separated key=value options, such as
+// "udp://127.0.0.1:53 weight=5". The protocol defaults to TCP, and the port to the standard port
+// for the protocol.
+func parseUpstreamConfig(str string) (tUpstreamConfig, error) {
+	fields := strings.Fields(str)
+	if len(fields) == 0 {
+		return tUpstreamConfig{}, fmt.Errorf("empty upstream entry")
+	}
+	config := tUpstreamConfig{
+		Name:     fields[0],
+		Protocol: upstreamProtocolTCP,
+		Addr:     fields[0],
+		Weight:   1,
+	}
+	if protocol, addr, found := strings.Cut(fields[0], "://"); found {
+		config.Protocol = protocol
+		config.Addr = addr
+	}
+	if config.Protocol == upstreamProtocolHTTPS {
+		u, err := url.Parse(config.Name)
+		if err != nil {
+			return config, fmt.Errorf("invalid url %s: %s", config.Name, err.Error())
+		}
+		config.Addr = u.Host
+	}
+	if _, _, err := net.SplitHostPort(config.Addr); err != nil {
+		if port, known := upstreamDefaultPorts[config.Protocol]; known {
+			config.Addr = net.JoinHostPort(strings.Trim(config.Addr, "[]"), port)
+		}
+	}
+
+	for _, option := range fields[1:] {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return config, fmt.Errorf("invalid option %s for %s", option, config.Name)
+		}
+
+		switch parts[0] {
+		case "weight":
+			weight, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return config, fmt.Errorf("invalid weight %s for %s", parts[1], config.Name)
+			}
+			config.Weight = weight
+		case "sni":
+			config.SNI = parts[1]
+		case "ca":
+			config.CAPath = parts[1]
+		case "pin":
+			config.Pins = append(config.Pins, parts[1])
+		default:
+			return config, fmt.Errorf("unknown option %s for %s", parts[0], config.Name)
+		}
+	}
+
+	return config, nil
+}
+
+// parseList splits a comma separated list of values, ignoring any empty values
+func parseList(str string) []string {
+	values := []string{}
+	for _, value := range strings.Split(str, ",") {
+		value = strings.Trim(value, " ")
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
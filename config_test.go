@@ -49,6 +49,22 @@ func TestParseConfig(t *testing.T) {
 	TestConfig(configPath)
 }
 
+func TestParseUpstreamList(t *testing.T) {
+	servers, err := parseUpstreamList("udp://192.0.2.1 weight=5, tls://[2001:db8::1]")
+	if err != nil {
+		t.Fatalf("Error parsing upstream list: %s", err.Error())
+	}
+	if len(servers) != 2 || servers[0].Addr != "192.0.2.1:53" || servers[0].Weight != 5 || servers[1].Addr != "[2001:db8::1]:853" {
+		t.Errorf("Unexpected upstream servers %+v", servers)
+	}
+
+	for _, value := range []string{"192.0.2.1,\t", "\t", "192.0.2.1 weight", "192.0.2.1 foo=bar"} {
+		if _, err := parseUpstreamList(value); err == nil {
+			t.Errorf("Invalid upstream list '%s' was accepted", value)
+		}
+	}
+}
+
 func generateTestCert(certPath, keyPath string) {
 	pKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
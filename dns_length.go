@@ -6,10 +6,19 @@ import (
 	"io"
 
 	"github.com/ecnepsnai/logtic"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // shared proxy code as DoT and DoQ work the same
 func proxyDNSMessageWithLength(log *logtic.Source, proto, remoteAddr string, rw io.ReadWriter) error {
+	// Access control rules are checked before the message is read, so that denied clients can be
+	// disconnected straight away
+	allowed := clientAllowed(proto, remoteAddr)
+	if !allowed && serverConfig.ACLDenyAction == aclDenyClose {
+		recordClientDenied(proto, remoteAddr)
+		return errClientDenied
+	}
+
 	rawSize := make([]byte, 2)
 
 	if _, err := rw.Read(rawSize); err != nil {
@@ -37,27 +46,62 @@ func proxyDNSMessageWithLength(log *logtic.Source, proto, remoteAddr string, rw
 
 	message = append(rawSize, message...)
 
-	reply := processControlQuery(remoteAddr, message)
+	if !allowed {
+		recordClientDenied(proto, remoteAddr)
+		if reply := buildErrorReply(message, dnsmessage.RCodeRefused, &extendedError{code: edeProhibited, text: "client is not permitted"}); reply != nil {
+			rw.Write(reply)
+		}
+		return errClientDenied
+	}
+
+	if queryRateLimited(proto, remoteAddr) {
+		if reply := rateLimitedReply(message, serverConfig.RateLimitAction); reply != nil {
+			rw.Write(reply)
+		}
+		return errRateLimited
+	}
+
+	reply, upstream := processLocalQuery(remoteAddr, message)
 	if reply == nil {
 		var err error
-		reply, err = proxyDnsMessage(message)
+		reply, upstream, err = proxyDnsMessage(message)
+		if err == errQueryDropped {
+			log.PDebug("Dropped DNS message", map[string]any{
+				"proto":   proto,
+				"from_ip": remoteAddr,
+			})
+			return nil
+		}
 		if err != nil {
 			log.PError("Error proxying DNS message", map[string]any{
 				"proto":   proto,
 				"from_ip": remoteAddr,
 				"error":   err.Error(),
 			})
+			// Tell the client the query failed, rather than leaving it to time out and retry
+			if reply := servfailReply(message, err); reply != nil {
+				if requestLog != nil {
+					requestLog.Record(proto, remoteAddr, upstream, message, reply)
+				}
+				rw.Write(reply)
+			}
 			return err
 		}
+		reply = protectRebinding(remoteAddr, upstream, message, reply)
+	}
+
+	if responseRateLimited(proto, remoteAddr, message, reply) {
+		return errRateLimited
 	}
 
 	if requestLog != nil {
-		requestLog.Record(proto, remoteAddr, message, reply)
+		requestLog.Record(proto, remoteAddr, upstream, message, reply)
 	}
 
 	log.PDebug("Proxied DNS message", map[string]any{
-		"proto":   proto,
-		"from_ip": remoteAddr,
+		"proto":    proto,
+		"from_ip":  remoteAddr,
+		"upstream": upstream,
 	})
 	rw.Write(reply)
 	return nil
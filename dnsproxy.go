@@ -21,7 +21,6 @@ package dnsproxy
 import (
 	"crypto/tls"
 	"dnsproxy/monitoring"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"sync"
@@ -52,6 +51,8 @@ var (
 	listenerHTTP6  net.Listener
 )
 
+var upstreams *upstreamGroup
+
 var (
 	serverShouldRestart = false
 	restartLock         = &sync.Mutex{}
@@ -67,7 +68,44 @@ func Start(configPath string) (bool, error) {
 		return false, fmt.Errorf("unable to load certificate or private key: %s", err.Error())
 	}
 
+	upstreams, err = newUpstreamGroup(serverConfig.DNSServers, serverConfig.UpstreamStrategy)
+	if err != nil {
+		return false, err
+	}
+	if err := setupForwardZones(); err != nil {
+		return false, err
+	}
+	if err := setupBlocklist(); err != nil {
+		return false, err
+	}
+	if err := setupRPZ(); err != nil {
+		return false, err
+	}
+	if err := setupLocalRecords(); err != nil {
+		return false, err
+	}
+	if err := setupLocalZones(); err != nil {
+		return false, err
+	}
+	setupACL()
+	setupRateLimits()
+	setupRebindProtection()
+	if serverConfig.CacheMaxEntries > 0 {
+		dnsCache = newResponseCache(cacheOptionsFromConfig())
+		if serverConfig.CachePersistPath != "" {
+			loadCache()
+		}
+	}
+
 	if serverConfig.ZabbixHost != nil {
+		for _, server := range serverConfig.DNSServers {
+			monitoring.RegisterUpstream(server.Name)
+		}
+		for _, zone := range serverConfig.ForwardZones {
+			for _, server := range zone.Servers {
+				monitoring.RegisterUpstream(server.Name)
+			}
+		}
 		go monitoring.Setup(serverConfig.ServerName, *serverConfig.ZabbixHost)
 	}
 
@@ -117,10 +155,21 @@ func stop(restart bool) {
 	}
 	restartLock.Unlock()
 
+	if dnsCache != nil && serverConfig.CachePersistPath != "" {
+		saveCache()
+	}
 	logtic.Log.Close()
 	if requestLog != nil {
 		requestLog.Close()
 	}
+	if upstreams != nil {
+		upstreams.Close()
+	}
+	closeForwardZones()
+	closeBlocklist()
+	closeLocalZones()
+	closeRPZ()
+	dnsCache = nil
 	if listenerTLS4 != nil {
 		listenerTLS4.Close()
 		listenerTLS4 = nil
@@ -155,30 +204,111 @@ func stop(restart bool) {
 	}
 }
 
-// Proxy the given DNS message to the server.
+// Proxy the given DNS message to the server, or the servers for the matching forward zone, unless
+// there is a cached reply. Expired cached replies are served if the upstream servers fail. Response
+// policy zones are applied to the query and reply. Returns the reply and the address of the upstream
+// server that provided it.
 // The message MUST include a 2-byte big-endian length at the start.
-func proxyDnsMessage(message []byte) ([]byte, error) {
-	out, err := net.Dial("tcp", serverConfig.DNSServerAddr)
-	if err != nil {
-		return nil, err
+func proxyDnsMessage(message []byte) ([]byte, string, error) {
+	if zones := rpzZones.Load(); zones != nil && len(*zones) > 0 {
+		return resolveWithPolicy(message, *zones)
 	}
-	defer out.Close()
+	return resolveCached(message)
+}
 
-	if _, err := out.Write(message); err != nil {
-		return nil, err
+// resolveCached returns the cached reply to the given DNS message, or sends it to the upstream
+// servers.
+// The message MUST include a 2-byte big-endian length at the start.
+func resolveCached(message []byte) ([]byte, string, error) {
+	// The server may be stopped while the query is in flight, so the cache is only read once
+	cache := dnsCache
+
+	var key cacheKey
+	cacheable := false
+	if cache != nil {
+		key, cacheable = cacheKeyFor(message)
+	}
+	if cacheable {
+		reply, state := cache.Get(key, message)
+		switch state {
+		case cachePrefetch:
+			go prefetch(cache, key, message)
+			fallthrough
+		case cacheHit:
+			monitoring.RecordCacheHit()
+			return reply, cacheUpstreamName, nil
+		case cacheStale:
+			return resolveOrServeStale(cache, key, message, reply)
+		}
+		monitoring.RecordCacheMiss()
 	}
 
-	rawSize := make([]byte, 2)
-	if _, err := out.Read(rawSize); err != nil {
-		return nil, err
+	reply, u, err := resolve(message)
+	if err != nil {
+		return nil, "", err
+	}
+	if cacheable {
+		cache.Set(key, reply)
 	}
+	return reply, u.addr, nil
+}
+
+type upstreamResult struct {
+	reply    []byte
+	upstream *upstream
+	err      error
+}
 
-	size := binary.BigEndian.Uint16(rawSize)
+// resolveOrServeStale sends the given DNS message to the upstream servers, but returns the given
+// stale reply if they fail or don't reply within the client response timeout (RFC 8767). The
+// query is left to finish in the background so that the given cache is refreshed.
+// The message MUST include a 2-byte big-endian length at the start.
+func resolveOrServeStale(cache *responseCache, key cacheKey, message, staleReply []byte) ([]byte, string, error) {
+	result := make(chan upstreamResult, 1)
+	go func() {
+		reply, u, err := resolve(message)
+		if err == nil && !isServfail(reply) {
+			cache.Set(key, reply)
+		}
+		result <- upstreamResult{reply, u, err}
+	}()
 
-	replyData := make([]byte, int(size))
-	if _, err := out.Read(replyData); err != nil {
-		return nil, err
+	var err error
+	select {
+	case r := <-result:
+		if r.err == nil && !isServfail(r.reply) {
+			monitoring.RecordCacheMiss()
+			return r.reply, r.upstream.addr, nil
+		}
+		err = r.err
+		if err == nil {
+			err = fmt.Errorf("upstream server %s replied with SERVFAIL", r.upstream.addr)
+		}
+	case <-time.After(serverConfig.CacheClientResponseTimeout):
+		err = fmt.Errorf("no reply within %s", serverConfig.CacheClientResponseTimeout)
 	}
 
-	return append(rawSize, replyData...), nil
+	monitoring.RecordCacheStale()
+	log.PWarn("Serving stale reply from cache", map[string]any{
+		"name":  key.name,
+		"type":  key.qtype.String(),
+		"error": err.Error(),
+	})
+	return staleReply, cacheUpstreamName, nil
+}
+
+// prefetch refreshes the reply to the given DNS message in the given cache before it expires.
+// The message MUST include a 2-byte big-endian length at the start.
+func prefetch(cache *responseCache, key cacheKey, message []byte) {
+	monitoring.RecordQueryPrefetch()
+	reply, _, err := resolve(message)
+	if err != nil {
+		log.PDebug("Error prefetching DNS message", map[string]any{
+			"name":  key.name,
+			"type":  key.qtype.String(),
+			"error": err.Error(),
+		})
+		return
+	}
+	cache.Set(key, reply)
 }
@@ -46,6 +46,17 @@ func TestMain(m *testing.M) {
 	os.Exit(result)
 }
 
+// setTestConfig replaces the server configuration with a copy changed by update until the test
+// finishes. The servers started by TestMain read the configuration while handling queries, so this
+// must not be called while any queries are in flight.
+func setTestConfig(t *testing.T, update func(config *tServerConfig)) {
+	config := serverConfig
+	testConfig := *config
+	update(&testConfig)
+	serverConfig = &testConfig
+	t.Cleanup(func() { serverConfig = config })
+}
+
 func setupPki() {
 	pKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	if err != nil {
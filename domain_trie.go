@@ -0,0 +1,94 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"strings"
+)
+
+// domainTrie is a set of domain names stored as a trie of labels from the root down, so that a name
+// can be matched against every one of its parent domains in a single walk.
+type domainTrie struct {
+	root *trieNode
+	size int
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	terminal bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &trieNode{}}
+}
+
+// Add adds the given domain name to the trie. Names are case insensitive and may be fully qualified.
+// Returns false if the name was already in the trie.
+func (t *domainTrie) Add(name string) bool {
+	node := t.root
+	labels := domainLabels(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = map[string]*trieNode{}
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &trieNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if node.terminal {
+		return false
+	}
+	node.terminal = true
+	t.size++
+	return true
+}
+
+// Match returns true if the given domain name, or any of its parent domains, is in the trie
+func (t *domainTrie) Match(name string) bool {
+	node := t.root
+	labels := domainLabels(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+	}
+	return false
+}
+
+// Len returns the number of names in the trie
+func (t *domainTrie) Len() int {
+	return t.size
+}
+
+// domainLabels returns the lowercase labels of the given domain name, without the root label
+func domainLabels(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
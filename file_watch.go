@@ -0,0 +1,98 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileWatchDelay is how long to wait after a watched file changes before reloading it, so that a
+// file being written in several steps is only reloaded once
+const fileWatchDelay = 500 * time.Millisecond
+
+// fileWatcher calls a function when any of a set of files is changed, replaced, or removed
+type fileWatcher struct {
+	paths    map[string]bool
+	onChange func()
+	stop     func()
+	timer    *time.Timer
+	lock     *sync.Mutex
+	closed   bool
+}
+
+// newFileWatcher starts watching the files at the given paths, calling onChange once the files
+// have stopped changing. The files don't need to exist yet.
+func newFileWatcher(paths []string, onChange func()) (*fileWatcher, error) {
+	w := &fileWatcher{
+		paths:    map[string]bool{},
+		onChange: onChange,
+		lock:     &sync.Mutex{},
+	}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		w.paths[abs] = true
+	}
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// changed is called by the platform watcher when a watched file changes
+func (w *fileWatcher) changed(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	log.PDebug("Watched file changed", map[string]any{
+		"path": path,
+	})
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(fileWatchDelay, func() {
+		w.lock.Lock()
+		closed := w.closed
+		w.lock.Unlock()
+		if !closed {
+			w.onChange()
+		}
+	})
+}
+
+// Close stops watching the files
+func (w *fileWatcher) Close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.lock.Unlock()
+	w.stop()
+}
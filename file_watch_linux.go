@@ -0,0 +1,89 @@
+//go:build linux
+
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// start watches the directories containing the files with inotify, so that files which are
+// replaced by renaming a new file over them are still seen
+func (w *fileWatcher) start() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// Using a non-blocking file lets Close interrupt a pending read
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	dirs := map[int]string{}
+	for path := range w.paths {
+		dir := filepath.Dir(path)
+		wd, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_DELETE)
+		if err != nil {
+			file.Close()
+			return &os.PathError{Op: "watch", Path: dir, Err: err}
+		}
+		dirs[wd] = dir
+	}
+
+	w.stop = func() { file.Close() }
+	go w.readEvents(file, dirs)
+	return nil
+}
+
+func (w *fileWatcher) readEvents(file *os.File, dirs map[int]string) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.PError("Error reading file change events", map[string]any{
+					"error": err.Error(),
+				})
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			offset = nameEnd
+
+			if dir, ok := dirs[int(event.Wd)]; ok && name != "" {
+				if path := filepath.Join(dir, name); w.paths[path] {
+					w.changed(path)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+//go:build !linux
+
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"os"
+	"time"
+)
+
+// fileWatchPollInterval is how often watched files are checked for changes on platforms without
+// inotify
+const fileWatchPollInterval = 5 * time.Second
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
+
+// start polls the files for changes to their modification time or size
+func (w *fileWatcher) start() error {
+	states := map[string]fileState{}
+	for path := range w.paths {
+		states[path] = statFile(path)
+	}
+
+	done := make(chan struct{})
+	w.stop = func() { close(done) }
+	go func() {
+		ticker := time.NewTicker(fileWatchPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			for path, previous := range states {
+				if current := statFile(path); current != previous {
+					states[path] = current
+					w.changed(path)
+				}
+			}
+		}
+	}()
+	return nil
+}
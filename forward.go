@@ -0,0 +1,83 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// forwardZones maps lowercase zone names to the upstream servers that answer queries for names
+// within that zone
+var forwardZones map[string]*upstreamGroup
+
+func setupForwardZones() error {
+	forwardZones = map[string]*upstreamGroup{}
+	for _, zone := range serverConfig.ForwardZones {
+		group, err := newUpstreamGroup(zone.Servers, serverConfig.UpstreamStrategy)
+		if err != nil {
+			closeForwardZones()
+			return err
+		}
+		forwardZones[strings.ToLower(zone.Zone)] = group
+	}
+	return nil
+}
+
+func closeForwardZones() {
+	for _, group := range forwardZones {
+		group.Close()
+	}
+	forwardZones = nil
+}
+
+// upstreamGroupFor returns the upstream servers that should answer the given DNS message. The most
+// specific forward zone that contains the question name is used, otherwise the default upstream
+// servers.
+// The message MUST include a 2-byte big-endian length at the start.
+func upstreamGroupFor(message []byte) *upstreamGroup {
+	if len(forwardZones) == 0 {
+		return upstreams
+	}
+
+	p := dnsmessage.Parser{}
+	if _, err := p.Start(message[2:]); err != nil {
+		return upstreams
+	}
+	q, err := p.Question()
+	if err != nil {
+		return upstreams
+	}
+
+	name := strings.ToLower(q.Name.String())
+	for {
+		if group, ok := forwardZones[name]; ok {
+			return group
+		}
+		if name == "." {
+			return upstreams
+		}
+		_, parent, _ := strings.Cut(name, ".")
+		if parent == "" {
+			parent = "."
+		}
+		name = parent
+	}
+}
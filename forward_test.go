@@ -0,0 +1,50 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import "testing"
+
+func TestUpstreamGroupFor(t *testing.T) {
+	corp := &upstreamGroup{}
+	dev := &upstreamGroup{}
+	rfc1918 := &upstreamGroup{}
+
+	defaultZones := forwardZones
+	forwardZones = map[string]*upstreamGroup{
+		"corp.example.":         corp,
+		"dev.corp.example.":     dev,
+		"168.192.in-addr.arpa.": rfc1918,
+	}
+	defer func() { forwardZones = defaultZones }()
+
+	check := func(name string, expect *upstreamGroup) {
+		if actual := upstreamGroupFor(buildTestQuery(name, false)); actual != expect {
+			t.Errorf("Unexpected upstream group for %s", name)
+		}
+	}
+
+	check("corp.example.", corp)
+	check("www.CORP.example.", corp)
+	check("dev.corp.example.", dev)
+	check("host.dev.corp.example.", dev)
+	check("notcorp.example.", upstreams)
+	check("example.", upstreams)
+	check("1.1.168.192.in-addr.arpa.", rfc1918)
+	check("1.1.1.1.in-addr.arpa.", upstreams)
+}
@@ -9,10 +9,10 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/quic-go/quic-go v0.59.0
 	golang.org/x/net v0.49.0
+	golang.org/x/sys v0.40.0
 )
 
 require (
 	go.uber.org/mock v0.6.0 // indirect
 	golang.org/x/crypto v0.47.0 // indirect
-	golang.org/x/sys v0.40.0 // indirect
 )
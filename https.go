@@ -83,6 +83,9 @@ type httpsServer struct {
 func (s *httpsServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if r := recover(); r != nil {
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
 			monitoring.RecordPanicRecover()
 			s.log.PError("HTTPS server paniced", map[string]any{
 				"error": fmt.Sprintf("%s", r),
@@ -134,6 +137,23 @@ func (s *httpsServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !clientAllowed("https", r.RemoteAddr) {
+		recordClientDenied("https", r.RemoteAddr)
+		rw.WriteHeader(403)
+		s.log.PDebug("Request finished", map[string]any{
+			"method":      r.Method,
+			"uri_stem":    r.URL.Path,
+			"status_code": 403,
+			"user_agent":  r.UserAgent(),
+		})
+		return
+	}
+
+	if queryRateLimited("https", r.RemoteAddr) {
+		s.rateLimited(rw, r)
+		return
+	}
+
 	if r.Method != "GET" && r.Method != "POST" {
 		rw.WriteHeader(405)
 		s.log.PDebug("Request finished", map[string]any{
@@ -234,10 +254,18 @@ func (s *httpsServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	message = append(length, message...)
 
-	reply := processControlQuery(r.RemoteAddr, message)
+	reply, upstream := processLocalQuery(r.RemoteAddr, message)
 	if reply == nil {
 		var err error
-		reply, err = proxyDnsMessage(message)
+		reply, upstream, err = proxyDnsMessage(message)
+		if err == errQueryDropped {
+			s.log.PDebug("Request dropped", map[string]any{
+				"method":   r.Method,
+				"uri_stem": r.URL.Path,
+			})
+			// Abort the request without sending a response
+			panic(http.ErrAbortHandler)
+		}
 		if err != nil {
 			log.PError("Error proxying DNS message", map[string]any{
 				"proto":   "https",
@@ -245,21 +273,46 @@ func (s *httpsServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 				"error":   err.Error(),
 			})
 			monitoring.RecordQueryDohError()
-			rw.WriteHeader(500)
-			rw.Write([]byte("internal server error"))
+			reply = servfailReply(message, err)
+			if reply == nil {
+				rw.WriteHeader(400)
+				rw.Write([]byte("invalid dns message"))
+				s.log.PDebug("Request finished", map[string]any{
+					"method":      r.Method,
+					"uri_stem":    r.URL.Path,
+					"status_code": 400,
+					"user_agent":  r.UserAgent(),
+					"error":       err.Error(),
+				})
+				return
+			}
+			if requestLog != nil {
+				requestLog.Record("https", r.RemoteAddr, upstream, message, reply)
+			}
+			// Tell the client the query failed with a DNS reply, rather than an HTTP error
+			rw.Header().Set("Content-Type", "application/dns-message")
+			rw.Header().Set("Content-Length", fmt.Sprintf("%d", len(reply[2:])))
+			rw.WriteHeader(200)
+			rw.Write(reply[2:])
 			s.log.PDebug("Request finished", map[string]any{
 				"method":      r.Method,
 				"uri_stem":    r.URL.Path,
-				"status_code": 400,
+				"status_code": 200,
 				"user_agent":  r.UserAgent(),
 				"error":       err.Error(),
 			})
 			return
 		}
+		reply = protectRebinding(r.RemoteAddr, upstream, message, reply)
+	}
+
+	if responseRateLimited("https", r.RemoteAddr, message, reply) {
+		s.rateLimited(rw, r)
+		return
 	}
 
 	if requestLog != nil {
-		requestLog.Record("https", r.RemoteAddr, message, reply)
+		requestLog.Record("https", r.RemoteAddr, upstream, message, reply)
 	}
 	monitoring.RecordQueryDohForward()
 	rw.Header().Set("Content-Type", "application/dns-message")
@@ -271,5 +324,18 @@ func (s *httpsServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		"uri_stem":    r.URL.Path,
 		"status_code": 200,
 		"user_agent":  r.UserAgent(),
+		"upstream":    upstream,
+	})
+}
+
+// rateLimited tells the client that it has sent too many queries
+func (s *httpsServer) rateLimited(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Retry-After", "1")
+	rw.WriteHeader(429)
+	s.log.PDebug("Request finished", map[string]any{
+		"method":      r.Method,
+		"uri_stem":    r.URL.Path,
+		"status_code": 429,
+		"user_agent":  r.UserAgent(),
 	})
 }
@@ -0,0 +1,50 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+// localQueryHandler answers DNS messages without sending them to an upstream server
+type localQueryHandler struct {
+	// name is recorded as the upstream for messages answered by this handler
+	name string
+	// process returns the reply to the given DNS message, or nil if the handler doesn't answer it.
+	// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+	process func(remoteAddr string, message []byte) []byte
+}
+
+// localQueryHandlers are tried in order for every DNS message before it is sent upstream
+var localQueryHandlers = []localQueryHandler{
+	{"", processControlQuery},
+	{anyUpstreamName, processAnyQuery},
+	{localRecordsUpstreamName, processLocalRecordQuery},
+	{localZoneUpstreamName, processLocalZoneQuery},
+	{blocklistUpstreamName, processBlockedQuery},
+}
+
+// processLocalQuery returns the reply to the given DNS message from the first local handler that
+// answers it, along with the name of that handler. Returns nil if the message should be sent to an
+// upstream server.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func processLocalQuery(remoteAddr string, message []byte) ([]byte, string) {
+	for _, handler := range localQueryHandlers {
+		if reply := handler.process(remoteAddr, message); reply != nil {
+			return reply, handler.name
+		}
+	}
+	return nil, ""
+}
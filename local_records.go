@@ -0,0 +1,243 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bufio"
+	"dnsproxy/monitoring"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localRecordsUpstreamName is recorded as the upstream for queries answered from local records
+const localRecordsUpstreamName = "local"
+
+// maxCNAMEChain is the most CNAME records that will be followed when answering a query locally
+const maxCNAMEChain = 8
+
+// localRecords are the records from the config and hosts file by lowercase owner name, or nil if
+// there are none
+var localRecords map[string][]dnsmessage.Resource
+
+func setupLocalRecords() error {
+	localRecords = nil
+
+	records := []dnsmessage.Resource{}
+	for _, line := range serverConfig.LocalRecords {
+		rr, err := parseZoneRecord(line, ".", serverConfig.LocalTTL)
+		if err != nil {
+			return fmt.Errorf("invalid local_record %s: %s", line, err.Error())
+		}
+		records = append(records, rr)
+	}
+	if serverConfig.HostsPath != "" {
+		hosts, err := loadHostsFile(serverConfig.HostsPath, serverConfig.LocalTTL)
+		if err != nil {
+			return fmt.Errorf("unable to load hosts file %s: %s", serverConfig.HostsPath, err.Error())
+		}
+		records = append(records, hosts...)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	byName := map[string][]dnsmessage.Resource{}
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header.Name.String())
+		byName[name] = append(byName[name], rr)
+	}
+	ptrs := 0
+	if serverConfig.LocalAutoPTR {
+		ptrs = addPTRRecords(byName, records)
+	}
+	localRecords = byName
+
+	log.PInfo("Loaded local records", map[string]any{
+		"records": len(records),
+		"ptr":     ptrs,
+	})
+	return nil
+}
+
+// loadHostsFile returns A and AAAA records for every name in the hosts file at the given path.
+// Lines that can't be parsed are skipped.
+func loadHostsFile(path string, ttl uint32) ([]dnsmessage.Resource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []dnsmessage.Resource{}
+	invalid := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || len(fields) < 2 {
+			invalid++
+			continue
+		}
+		for _, host := range fields[1:] {
+			if !isValidDomain(host) {
+				invalid++
+				continue
+			}
+			name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+			if err != nil {
+				invalid++
+				continue
+			}
+			records = append(records, addressRecords(dnsmessage.Question{Name: name, Type: addrType(addr)}, []netip.Addr{addr.Unmap()}, ttl)...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	log.PInfo("Loaded hosts file", map[string]any{
+		"path":    path,
+		"records": len(records),
+		"invalid": invalid,
+	})
+	return records, nil
+}
+
+// addrType returns the record type for the given address
+func addrType(addr netip.Addr) dnsmessage.Type {
+	if addr.Unmap().Is4() {
+		return dnsmessage.TypeA
+	}
+	return dnsmessage.TypeAAAA
+}
+
+// addPTRRecords adds a PTR record for the address of each A and AAAA record, unless there is
+// already a PTR record for that address. The first name with an address is used. Returns the
+// number of records added.
+func addPTRRecords(byName map[string][]dnsmessage.Resource, records []dnsmessage.Resource) int {
+	added := 0
+	for _, rr := range records {
+		var addr netip.Addr
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(body.AAAA)
+		default:
+			continue
+		}
+
+		reverse := reverseName(addr)
+		if len(recordsOfType(byName[reverse], dnsmessage.TypePTR)) > 0 {
+			continue
+		}
+		name, err := dnsmessage.NewName(reverse)
+		if err != nil {
+			continue
+		}
+		byName[reverse] = append(byName[reverse], dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: rr.Header.TTL},
+			Body:   &dnsmessage.PTRResource{PTR: rr.Header.Name},
+		})
+		added++
+	}
+	return added
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name for the given address
+func reverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	b := strings.Builder{}
+	if addr.Is4() {
+		ip := addr.As4()
+		for i := len(ip) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip[i])
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+	ip := addr.As16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0x0f, ip[i]>>4)
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// processLocalRecordQuery answers queries for names that have local records, following CNAME
+// records to other local names or the upstream servers. Returns nil if the name has no local
+// records.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func processLocalRecordQuery(remoteAddr string, message []byte) []byte {
+	if localRecords == nil {
+		return nil
+	}
+	q, ok := questionOf(message)
+	if !ok || q.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	records, ok := localRecords[strings.ToLower(q.Name.String())]
+	if !ok {
+		return nil
+	}
+
+	monitoring.RecordQueryLocal()
+	log.PDebug("Answered query from local records", map[string]any{
+		"from_ip": remoteAddr,
+		"name":    q.Name.String(),
+		"type":    q.Type.String(),
+	})
+
+	answer := localAnswer{rcode: dnsmessage.RCodeSuccess, authoritative: true}
+	name := q.Name
+	for range maxCNAMEChain {
+		var cname *dnsmessage.Resource
+		matched := false
+		for _, rr := range records {
+			rr.Header.Name = name
+			if rr.Header.Type == q.Type || q.Type == dnsmessage.TypeALL {
+				answer.answers = append(answer.answers, rr)
+				matched = true
+			} else if rr.Header.Type == dnsmessage.TypeCNAME {
+				cname = &rr
+			}
+		}
+		if matched || cname == nil {
+			break
+		}
+
+		answer.answers = append(answer.answers, *cname)
+		name = cname.Body.(*dnsmessage.CNAMEResource).CNAME
+		if records, ok = localRecords[strings.ToLower(name.String())]; !ok {
+			// The rest of the answer comes from the upstream servers
+			answer.authoritative = false
+			answer.answers = append(answer.answers, resolveCNAMETarget(name, q)...)
+			break
+		}
+	}
+	return buildReply(message, answer)
+}
@@ -0,0 +1,147 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestReverseName(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"192.0.2.1":          "1.2.0.192.in-addr.arpa.",
+		"::ffff:10.0.0.1":    "1.0.0.10.in-addr.arpa.",
+		"2001:db8::567:89ab": "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	} {
+		if name := reverseName(netip.MustParseAddr(addr)); name != expected {
+			t.Errorf("Unexpected reverse name for %s: %s", addr, name)
+		}
+	}
+}
+
+func TestLocalRecords(t *testing.T) {
+	hostsPath := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hostsPath, []byte("# hosts\n192.168.1.20 printer.home.arpa printer-alias.home.arpa\n2001:db8::20 printer.home.arpa\nnot-an-ip host\n"), 0644); err != nil {
+		t.Fatalf("Error writing hosts file: %s", err.Error())
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.LocalTTL = 120
+		config.LocalAutoPTR = true
+		config.HostsPath = hostsPath
+		config.LocalRecords = []string{
+			"nas.home.arpa A 192.168.1.10",
+			"nas.home.arpa 60 AAAA 2001:db8::10",
+			"files.home.arpa CNAME nas.home.arpa.",
+			"home.arpa TXT \"hello world\"",
+			"30.1.168.192.in-addr.arpa PTR custom.home.arpa.",
+			"other.home.arpa A 192.168.1.10",
+		}
+	})
+	t.Cleanup(func() { localRecords = nil })
+	if err := setupLocalRecords(); err != nil {
+		t.Fatalf("Error loading local records: %s", err.Error())
+	}
+
+	query := func(name string, qtype dnsmessage.Type) *dnsmessage.Message {
+		builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: 1234, RecursionDesired: true})
+		builder.StartQuestions()
+		builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+		message, err := builder.Finish()
+		if err != nil {
+			t.Fatalf("Error building query: %s", err.Error())
+		}
+		binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+
+		replyData := processLocalRecordQuery("127.0.0.1:1234", message)
+		if replyData == nil {
+			return nil
+		}
+		reply := &dnsmessage.Message{}
+		if err := reply.Unpack(replyData[2:]); err != nil {
+			t.Fatalf("Error parsing reply: %s", err.Error())
+		}
+		return reply
+	}
+
+	if reply := query("example.com.", dnsmessage.TypeA); reply != nil {
+		t.Errorf("Name without local records was answered")
+	}
+
+	reply := query("NAS.home.arpa.", dnsmessage.TypeA)
+	if reply == nil || !reply.Authoritative || len(reply.Answers) != 1 {
+		t.Fatalf("Unexpected reply for local record %+v", reply)
+	}
+	if a := reply.Answers[0]; a.Header.TTL != 120 || a.Body.(*dnsmessage.AResource).A != [4]byte{192, 168, 1, 10} || a.Header.Name.String() != "NAS.home.arpa." {
+		t.Errorf("Unexpected A record %+v", a)
+	}
+	if reply := query("nas.home.arpa.", dnsmessage.TypeAAAA); len(reply.Answers) != 1 || reply.Answers[0].Header.TTL != 60 {
+		t.Errorf("Unexpected AAAA reply %+v", reply.Answers)
+	}
+	if reply := query("nas.home.arpa.", dnsmessage.TypeMX); reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 0 {
+		t.Errorf("Unexpected NODATA reply %s %+v", reply.RCode, reply.Answers)
+	}
+
+	reply = query("files.home.arpa.", dnsmessage.TypeA)
+	if len(reply.Answers) != 2 || reply.Answers[0].Header.Type != dnsmessage.TypeCNAME || reply.Answers[1].Header.Name.String() != "nas.home.arpa." {
+		t.Errorf("CNAME was not followed %+v", reply.Answers)
+	}
+
+	if reply := query("home.arpa.", dnsmessage.TypeTXT); len(reply.Answers) != 1 || reply.Answers[0].Body.(*dnsmessage.TXTResource).TXT[0] != "hello world" {
+		t.Errorf("Unexpected TXT reply %+v", reply.Answers)
+	}
+
+	if reply := query("printer-alias.home.arpa.", dnsmessage.TypeA); len(reply.Answers) != 1 {
+		t.Errorf("Unexpected hosts file reply %+v", reply.Answers)
+	}
+	if reply := query("printer.home.arpa.", dnsmessage.TypeAAAA); len(reply.Answers) != 1 {
+		t.Errorf("Unexpected hosts file reply %+v", reply.Answers)
+	}
+
+	for name, expected := range map[string]string{
+		"10.1.168.192.in-addr.arpa.":                     "nas.home.arpa.",
+		"20.1.168.192.in-addr.arpa.":                     "printer.home.arpa.",
+		"30.1.168.192.in-addr.arpa.":                     "custom.home.arpa.",
+		reverseName(netip.MustParseAddr("2001:db8::20")): "printer.home.arpa.",
+	} {
+		reply := query(name, dnsmessage.TypePTR)
+		if reply == nil || len(reply.Answers) != 1 {
+			t.Errorf("Unexpected PTR reply for %s", name)
+			continue
+		}
+		if ptr := reply.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(); ptr != expected {
+			t.Errorf("Unexpected PTR for %s: %s", name, ptr)
+		}
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.LocalAutoPTR = false
+	})
+	if err := setupLocalRecords(); err != nil {
+		t.Fatalf("Error loading local records: %s", err.Error())
+	}
+	if reply := query("10.1.168.192.in-addr.arpa.", dnsmessage.TypePTR); reply != nil {
+		t.Errorf("PTR record was created with automatic PTR records disabled")
+	}
+}
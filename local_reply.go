@@ -0,0 +1,153 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Extended DNS Error codes (RFC 8914)
+const (
+	edeBlocked              uint16 = 15
+	edeFiltered             uint16 = 17
+	edeProhibited           uint16 = 18
+	edeNoReachableAuthority uint16 = 22
+	edeNetworkError         uint16 = 23
+)
+
+// ednsOptionExtendedError is the EDNS option code for an Extended DNS Error
+const ednsOptionExtendedError uint16 = 15
+
+// serverUDPPayloadSize is the EDNS UDP payload size advertised in replies that dnsproxy builds
+// itself, which is the size recommended by DNS Flag Day 2020
+const serverUDPPayloadSize = 1232
+
+// extendedError is an Extended DNS Error (RFC 8914) to include in a reply
+type extendedError struct {
+	code uint16
+	text string
+}
+
+// servfailReply returns a SERVFAIL reply to the given DNS message, describing the upstream error
+// with an Extended DNS Error if the client supports EDNS.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func servfailReply(message []byte, err error) []byte {
+	ede := &extendedError{code: edeNetworkError, text: "error communicating with upstream server"}
+	if errors.Is(err, errNoUpstreams) || isTimeout(err) {
+		ede = &extendedError{code: edeNoReachableAuthority, text: "no upstream server replied in time"}
+	}
+	return buildErrorReply(message, dnsmessage.RCodeServerFailure, ede)
+}
+
+// localAnswer is a reply that dnsproxy gives itself, rather than getting from an upstream server
+type localAnswer struct {
+	rcode         dnsmessage.RCode
+	authoritative bool
+	answers       []dnsmessage.Resource
+	authorities   []dnsmessage.Resource
+	additionals   []dnsmessage.Resource
+	ede           *extendedError
+}
+
+// buildErrorReply returns an empty reply to the given DNS message with the given response code,
+// along with the extended error if one is given. Returns nil if the message is too short to reply
+// to.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func buildErrorReply(message []byte, rcode dnsmessage.RCode, ede *extendedError) []byte {
+	return buildReply(message, localAnswer{rcode: rcode, ede: ede})
+}
+
+// buildReply returns a reply to the given DNS message with the records from the given answer. The
+// question is copied from the message, and if the message has an OPT record then the reply will
+// too, along with the extended error if one is given and extended errors are enabled. Returns nil
+// if the message is too short to reply to.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func buildReply(message []byte, answer localAnswer) []byte {
+	rcode := answer.rcode
+	ede := answer.ede
+	if len(message) < 14 {
+		return nil
+	}
+
+	query := &dnsmessage.Message{}
+	if err := query.Unpack(message[2:]); err != nil {
+		return buildHeaderOnlyReply(message, rcode)
+	}
+
+	reply := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			Authoritative:      answer.authoritative,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			CheckingDisabled:   query.CheckingDisabled,
+			RCode:              rcode,
+		},
+		Questions:   query.Questions,
+		Answers:     answer.answers,
+		Authorities: answer.authorities,
+		Additionals: slices.Clip(answer.additionals),
+	}
+
+	for _, rr := range query.Additionals {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+		opt := &dnsmessage.OPTResource{}
+		if ede != nil && serverConfig.ExtendedDNSErrors {
+			data := make([]byte, 2+len(ede.text))
+			binary.BigEndian.PutUint16(data, ede.code)
+			copy(data[2:], ede.text)
+			opt.Options = append(opt.Options, dnsmessage.Option{Code: ednsOptionExtendedError, Data: data})
+		}
+		var header dnsmessage.ResourceHeader
+		if err := header.SetEDNS0(serverUDPPayloadSize, rcode, false); err != nil {
+			return buildHeaderOnlyReply(message, rcode)
+		}
+		reply.Additionals = append(reply.Additionals, dnsmessage.Resource{Header: header, Body: opt})
+		break
+	}
+
+	replyData, err := reply.AppendPack(make([]byte, 2, 514))
+	if err != nil {
+		return buildHeaderOnlyReply(message, rcode)
+	}
+	binary.BigEndian.PutUint16(replyData, uint16(len(replyData)-2))
+	return replyData
+}
+
+// buildHeaderOnlyReply returns a reply to the given DNS message that has only a header, for when
+// the message can't be parsed.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func buildHeaderOnlyReply(message []byte, rcode dnsmessage.RCode) []byte {
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint16(reply, 12)
+	copy(reply[2:4], message[2:4])
+	// Keep the opcode and RD flag, set QR
+	reply[4] = 0x80 | (message[4] & 0x79)
+	// RA and the response code
+	reply[5] = 0x80 | byte(rcode&0x0f)
+	return reply
+}
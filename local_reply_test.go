@@ -0,0 +1,78 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestServfailReply(t *testing.T) {
+	for _, withOPT := range []bool{false, true} {
+		message := buildTestQuery("example.com.", withOPT)
+		replyData := servfailReply(message, errUpstreamTimeout)
+		if replyData == nil {
+			t.Fatalf("No reply built")
+		}
+		if int(binary.BigEndian.Uint16(replyData)) != len(replyData)-2 {
+			t.Errorf("Incorrect reply length")
+		}
+
+		reply := &dnsmessage.Message{}
+		if err := reply.Unpack(replyData[2:]); err != nil {
+			t.Fatalf("Error parsing reply: %s", err.Error())
+		}
+		if reply.ID != 1234 || !reply.Response || reply.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("Unexpected reply header: %+v", reply.Header)
+		}
+		if len(reply.Questions) != 1 || reply.Questions[0].Name.String() != "example.com." {
+			t.Errorf("Question not copied to reply")
+		}
+
+		if !withOPT {
+			if len(reply.Additionals) != 0 {
+				t.Errorf("Unexpected OPT record in reply to query without one")
+			}
+			continue
+		}
+
+		if len(reply.Additionals) != 1 || reply.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+			t.Fatalf("No OPT record in reply")
+		}
+		if size := int(reply.Additionals[0].Header.Class); size != serverUDPPayloadSize {
+			t.Errorf("Unexpected advertised UDP payload size %d", size)
+		}
+		opt := reply.Additionals[0].Body.(*dnsmessage.OPTResource)
+		if len(opt.Options) != 1 || opt.Options[0].Code != ednsOptionExtendedError {
+			t.Fatalf("No extended error in reply")
+		}
+		if code := binary.BigEndian.Uint16(opt.Options[0].Data); code != edeNoReachableAuthority {
+			t.Errorf("Unexpected extended error code %d", code)
+		}
+	}
+
+	// Replies to messages that can't be parsed only have a header
+	message := []byte{0, 12, 0xab, 0xcd, 0x01, 0, 0, 5, 0, 0, 0, 0, 0, 0}
+	replyData := servfailReply(message, errNoUpstreams)
+	if len(replyData) != 14 || replyData[2] != 0xab || replyData[3] != 0xcd || replyData[4] != 0x81 || replyData[5]&0x0f != byte(dnsmessage.RCodeServerFailure) {
+		t.Errorf("Unexpected header only reply %x", replyData)
+	}
+}
@@ -0,0 +1,344 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"dnsproxy/monitoring"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localZoneUpstreamName is recorded as the upstream for queries answered from a local zone
+const localZoneUpstreamName = "zone"
+
+// typeDS is the DS record type, which dnsmessage doesn't define
+const typeDS dnsmessage.Type = 43
+
+// localZone is a zone loaded from a zone file that is answered authoritatively
+type localZone struct {
+	name string
+	path string
+	soa  dnsmessage.Resource
+	// records are the records in the zone by lowercase owner name
+	records map[string][]dnsmessage.Resource
+	// names are every name that exists in the zone, including empty non-terminals
+	names map[string]bool
+}
+
+// localZones are the loaded local zones. The set of zones is replaced as a whole when the zone files
+// are reloaded.
+var localZones = &atomic.Pointer[[]*localZone]{}
+
+// localZoneWatcher reloads the local zone files when they change
+var localZoneWatcher *fileWatcher
+
+func setupLocalZones() error {
+	closeLocalZones()
+	localZones.Store(nil)
+	if len(serverConfig.LocalZones) == 0 {
+		return nil
+	}
+
+	zones := []*localZone{}
+	paths := []string{}
+	for _, config := range serverConfig.LocalZones {
+		zone, err := loadLocalZone(config.Zone, config.Path)
+		if err != nil {
+			return fmt.Errorf("unable to load local zone %s: %s", config.Zone, err.Error())
+		}
+		zones = append(zones, zone)
+		paths = append(paths, config.Path)
+	}
+	localZones.Store(&zones)
+
+	watcher, err := newFileWatcher(paths, reloadLocalZones)
+	if err != nil {
+		return fmt.Errorf("unable to watch local zone files: %s", err.Error())
+	}
+	localZoneWatcher = watcher
+	return nil
+}
+
+func closeLocalZones() {
+	if localZoneWatcher != nil {
+		localZoneWatcher.Close()
+		localZoneWatcher = nil
+	}
+}
+
+// reloadLocalZones loads the local zone files again. Zones that can't be loaded keep their current
+// records.
+func reloadLocalZones() {
+	current := localZones.Load()
+	if current == nil {
+		return
+	}
+
+	zones := make([]*localZone, len(*current))
+	for i, zone := range *current {
+		zones[i] = zone
+		reloaded, err := loadLocalZone(zone.name, zone.path)
+		if err != nil {
+			monitoring.RecordLocalZoneError()
+			log.PError("Error reloading local zone, keeping the current records", map[string]any{
+				"zone":  zone.name,
+				"path":  zone.path,
+				"error": err.Error(),
+			})
+			continue
+		}
+		zones[i] = reloaded
+	}
+	localZones.Store(&zones)
+}
+
+// loadLocalZone reads the zone with the given name from the zone file at the given path. The zone
+// must have an SOA record at its apex, records outside of the zone are skipped.
+func loadLocalZone(name, path string) (*localZone, error) {
+	name = strings.ToLower(name)
+	records, err := parseZoneFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	zone := &localZone{
+		name:    name,
+		path:    path,
+		records: map[string][]dnsmessage.Resource{},
+		names:   map[string]bool{name: true},
+	}
+	hasSOA := false
+	skipped := 0
+	for _, rr := range records {
+		owner := rr.Header.Name.String()
+		if !inZone(owner, name) {
+			skipped++
+			continue
+		}
+		if rr.Header.Type == dnsmessage.TypeSOA {
+			if owner != name || hasSOA {
+				return nil, fmt.Errorf("zone must have a single SOA record at %s", name)
+			}
+			zone.soa = rr
+			hasSOA = true
+		}
+		zone.records[owner] = append(zone.records[owner], rr)
+		for n := owner; n != name; n = parentName(n) {
+			zone.names[n] = true
+		}
+	}
+	if !hasSOA {
+		return nil, fmt.Errorf("zone must have a single SOA record at %s", name)
+	}
+
+	log.PInfo("Loaded local zone", map[string]any{
+		"zone":    name,
+		"path":    path,
+		"records": len(records) - skipped,
+		"skipped": skipped,
+	})
+	return zone, nil
+}
+
+// inZone returns true if the given lowercase name is the zone name or within the zone
+func inZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// parentName returns the name with the first label removed
+func parentName(name string) string {
+	_, parent, _ := strings.Cut(name, ".")
+	if parent == "" {
+		return "."
+	}
+	return parent
+}
+
+// findLocalZone returns the most specific local zone containing the given lowercase name, or nil
+func findLocalZone(name string) *localZone {
+	zones := localZones.Load()
+	if zones == nil {
+		return nil
+	}
+	var best *localZone
+	for _, zone := range *zones {
+		if inZone(name, zone.name) && (best == nil || len(zone.name) > len(best.name)) {
+			best = zone
+		}
+	}
+	return best
+}
+
+// processLocalZoneQuery answers queries for names within a local zone. Returns nil if the name is
+// not within a local zone.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func processLocalZoneQuery(remoteAddr string, message []byte) []byte {
+	if localZones.Load() == nil {
+		return nil
+	}
+	q, ok := questionOf(message)
+	if !ok || q.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	zone := findLocalZone(strings.ToLower(q.Name.String()))
+	if zone == nil {
+		return nil
+	}
+
+	monitoring.RecordQueryLocalZone()
+	log.PDebug("Answered query from local zone", map[string]any{
+		"from_ip": remoteAddr,
+		"zone":    zone.name,
+		"name":    q.Name.String(),
+		"type":    q.Type.String(),
+	})
+	return buildReply(message, zone.answer(q))
+}
+
+// answer returns the authoritative answer to the given question, following CNAME records within the
+// zone (RFC 1034 section 4.3.2)
+func (z *localZone) answer(q dnsmessage.Question) localAnswer {
+	answer := localAnswer{rcode: dnsmessage.RCodeSuccess, authoritative: true}
+	name := q.Name
+	for range maxCNAMEChain {
+		lowerName := strings.ToLower(name.String())
+		if !inZone(lowerName, z.name) {
+			// The CNAME target is outside of the zone, so the rest of the answer comes from the
+			// upstream servers
+			answer.authoritative = false
+			answer.answers = append(answer.answers, resolveCNAMETarget(name, q)...)
+			return answer
+		}
+
+		if referral, ok := z.referral(lowerName, q.Type); ok {
+			// Referrals are only given for the original name, a CNAME to a delegated name is left
+			// for the client to follow
+			if len(answer.answers) == 0 {
+				return referral
+			}
+			return answer
+		}
+
+		records, ok := z.records[lowerName]
+		if !ok {
+			records, ok = z.wildcard(lowerName)
+		}
+		if !ok {
+			if !z.names[lowerName] {
+				answer.rcode = dnsmessage.RCodeNameError
+			}
+			answer.authorities = []dnsmessage.Resource{z.negativeSOA()}
+			return answer
+		}
+
+		var cname *dnsmessage.Resource
+		matched := false
+		for _, rr := range records {
+			rr.Header.Name = name
+			if rr.Header.Type == q.Type || q.Type == dnsmessage.TypeALL {
+				answer.answers = append(answer.answers, rr)
+				matched = true
+			} else if rr.Header.Type == dnsmessage.TypeCNAME {
+				cname = &rr
+			}
+		}
+		if matched {
+			return answer
+		}
+		if cname == nil {
+			answer.authorities = []dnsmessage.Resource{z.negativeSOA()}
+			return answer
+		}
+		answer.answers = append(answer.answers, *cname)
+		name = cname.Body.(*dnsmessage.CNAMEResource).CNAME
+	}
+	return answer
+}
+
+// referral returns a referral to the delegated zone that contains the given name, if it is below a
+// zone cut. DS queries for the delegated zone itself are answered by this zone.
+func (z *localZone) referral(name string, qtype dnsmessage.Type) (localAnswer, bool) {
+	// Find the highest zone cut, starting from just below the apex
+	cuts := []string{}
+	for n := name; n != z.name && n != "."; n = parentName(n) {
+		cuts = append(cuts, n)
+	}
+	for i := len(cuts) - 1; i >= 0; i-- {
+		cut := cuts[i]
+		if cut == name && qtype == typeDS {
+			break
+		}
+		ns := recordsOfType(z.records[cut], dnsmessage.TypeNS)
+		if len(ns) == 0 {
+			continue
+		}
+
+		referral := localAnswer{authorities: ns}
+		for _, rr := range ns {
+			target := strings.ToLower(rr.Body.(*dnsmessage.NSResource).NS.String())
+			if !inZone(target, z.name) {
+				continue
+			}
+			referral.additionals = append(referral.additionals, recordsOfType(z.records[target], dnsmessage.TypeA)...)
+			referral.additionals = append(referral.additionals, recordsOfType(z.records[target], dnsmessage.TypeAAAA)...)
+		}
+		return referral, true
+	}
+	return localAnswer{}, false
+}
+
+// wildcard returns the records from the wildcard that matches the given name, which doesn't exist
+// in the zone (RFC 4592)
+func (z *localZone) wildcard(name string) ([]dnsmessage.Resource, bool) {
+	// The closest encloser is the nearest parent that exists, a wildcard can only be below it
+	encloser := name
+	for encloser != z.name && !z.names[encloser] {
+		encloser = parentName(encloser)
+	}
+	if encloser == name {
+		return nil, false
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	records, ok := z.records[wildcard]
+	return records, ok
+}
+
+// negativeSOA returns the SOA record to include in NXDOMAIN and NODATA replies, with the TTL set to
+// the negative caching TTL (RFC 2308 section 3)
+func (z *localZone) negativeSOA() dnsmessage.Resource {
+	soa := z.soa
+	soa.Header.TTL = min(soa.Header.TTL, soa.Body.(*dnsmessage.SOAResource).MinTTL)
+	return soa
+}
+
+func recordsOfType(records []dnsmessage.Resource, rrType dnsmessage.Type) []dnsmessage.Resource {
+	matched := []dnsmessage.Resource{}
+	for _, rr := range records {
+		if rr.Header.Type == rrType {
+			matched = append(matched, rr)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,182 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testLocalZone = `$TTL 3600
+@	SOA ns1 hostmaster 1 1h 15m 30d 300
+	NS ns1
+ns1	A 192.0.2.1
+www	A 192.0.2.10
+	AAAA 2001:db8::10
+alias	CNAME www
+loop	CNAME alias
+dangling	CNAME missing
+*.wild	A 192.0.2.20
+host.wild	TXT "exists"
+x.a.b	A 192.0.2.30
+sub	NS ns.sub
+	NS ns.example.net.
+ns.sub	A 192.0.2.53
+outside.example.net. A 192.0.2.99
+`
+
+func buildTestTypeQuery(name string, qtype dnsmessage.Type) []byte {
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	message, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+	binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+	return message
+}
+
+func TestLocalZone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "home.arpa.zone")
+	if err := os.WriteFile(path, []byte(testLocalZone), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.LocalZones = []tZoneFileConfig{{Zone: "home.arpa.", Path: path}}
+	})
+	t.Cleanup(func() { closeLocalZones(); localZones.Store(nil) })
+	if err := setupLocalZones(); err != nil {
+		t.Fatalf("Error loading local zone: %s", err.Error())
+	}
+
+	query := func(name string, qtype dnsmessage.Type) *dnsmessage.Message {
+		replyData := processLocalZoneQuery("127.0.0.1:1234", buildTestTypeQuery(name, qtype))
+		if replyData == nil {
+			return nil
+		}
+		reply := &dnsmessage.Message{}
+		if err := reply.Unpack(replyData[2:]); err != nil {
+			t.Fatalf("Error parsing reply: %s", err.Error())
+		}
+		return reply
+	}
+	types := func(records []dnsmessage.Resource) []dnsmessage.Type {
+		rrTypes := []dnsmessage.Type{}
+		for _, rr := range records {
+			rrTypes = append(rrTypes, rr.Header.Type)
+		}
+		return rrTypes
+	}
+
+	if reply := query("example.com.", dnsmessage.TypeA); reply != nil {
+		t.Errorf("Name outside of the zone was answered")
+	}
+	if reply := query("outside.example.net.", dnsmessage.TypeA); reply != nil {
+		t.Errorf("Out of zone record was answered")
+	}
+
+	reply := query("WWW.home.arpa.", dnsmessage.TypeA)
+	if !reply.Authoritative || reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 1 || reply.Answers[0].Header.Name.String() != "WWW.home.arpa." {
+		t.Errorf("Unexpected reply %+v", reply)
+	}
+
+	reply = query("loop.home.arpa.", dnsmessage.TypeAAAA)
+	if rrTypes := types(reply.Answers); len(rrTypes) != 3 || rrTypes[0] != dnsmessage.TypeCNAME || rrTypes[1] != dnsmessage.TypeCNAME || rrTypes[2] != dnsmessage.TypeAAAA {
+		t.Errorf("CNAME chain was not followed %v", rrTypes)
+	}
+
+	reply = query("dangling.home.arpa.", dnsmessage.TypeA)
+	if reply.RCode != dnsmessage.RCodeNameError || len(reply.Answers) != 1 || len(reply.Authorities) != 1 {
+		t.Errorf("Unexpected reply for CNAME to missing name %s %v", reply.RCode, types(reply.Answers))
+	}
+
+	reply = query("missing.home.arpa.", dnsmessage.TypeA)
+	if reply.RCode != dnsmessage.RCodeNameError || !reply.Authoritative || len(reply.Authorities) != 1 {
+		t.Fatalf("Unexpected NXDOMAIN reply %s %v", reply.RCode, types(reply.Authorities))
+	}
+	if soa := reply.Authorities[0]; soa.Header.Type != dnsmessage.TypeSOA || soa.Header.TTL != 300 {
+		t.Errorf("Unexpected SOA record in NXDOMAIN reply %+v", soa.Header)
+	}
+
+	for _, name := range []string{"www.home.arpa.", "a.b.home.arpa.", "b.home.arpa."} {
+		reply := query(name, dnsmessage.TypeMX)
+		if reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 0 || len(reply.Authorities) != 1 {
+			t.Errorf("Unexpected NODATA reply for %s: %s", name, reply.RCode)
+		}
+	}
+
+	reply = query("anything.wild.home.arpa.", dnsmessage.TypeA)
+	if len(reply.Answers) != 1 || reply.Answers[0].Header.Name.String() != "anything.wild.home.arpa." {
+		t.Errorf("Unexpected wildcard reply %+v", reply.Answers)
+	}
+	if reply := query("host.wild.home.arpa.", dnsmessage.TypeA); len(reply.Answers) != 0 {
+		t.Errorf("Wildcard matched a name that exists")
+	}
+	if reply := query("deep.name.wild.home.arpa.", dnsmessage.TypeA); len(reply.Answers) != 1 {
+		t.Errorf("Wildcard did not match a name several labels below it")
+	}
+	if reply := query("below.host.wild.home.arpa.", dnsmessage.TypeA); reply.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Wildcard matched below a name that exists")
+	}
+
+	for _, name := range []string{"sub.home.arpa.", "www.sub.home.arpa."} {
+		reply := query(name, dnsmessage.TypeA)
+		if reply.Authoritative || len(reply.Answers) != 0 || len(reply.Authorities) != 2 || len(reply.Additionals) != 1 {
+			t.Errorf("Unexpected referral for %s: %v %v", name, types(reply.Authorities), types(reply.Additionals))
+		}
+	}
+	if reply := query("sub.home.arpa.", typeDS); !reply.Authoritative || len(reply.Authorities) != 1 || reply.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+		t.Errorf("DS query at the zone cut was referred")
+	}
+
+	if reply := query("home.arpa.", dnsmessage.TypeNS); !reply.Authoritative || len(reply.Answers) != 1 {
+		t.Errorf("Unexpected apex NS reply %+v", reply)
+	}
+
+	// The zone is reloaded when the file changes, and kept if the new file is invalid
+	if err := os.WriteFile(path, []byte(testLocalZone+"new A 192.0.2.40\n"), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+	reloaded := false
+	for range 100 {
+		if reply := query("new.home.arpa.", dnsmessage.TypeA); len(reply.Answers) == 1 {
+			reloaded = true
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !reloaded {
+		t.Fatalf("Zone was not reloaded after the file changed")
+	}
+
+	if err := os.WriteFile(path, []byte("www A 192.0.2.10\n"), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+	time.Sleep(2 * fileWatchDelay)
+	if reply := query("new.home.arpa.", dnsmessage.TypeA); len(reply.Answers) != 1 {
+		t.Errorf("Zone was replaced by an invalid zone file")
+	}
+}
@@ -10,8 +10,11 @@ import (
 
 func setupLog() {
 	if serverConfig.RequestsLogPath != nil {
-		if err := requestLog.Open(*serverConfig.RequestsLogPath); err != nil {
+		w := &requestLogWriter{}
+		if err := w.Open(*serverConfig.RequestsLogPath); err != nil {
 			fmt.Fprintf(os.Stderr, "Unable to open requests log file: %s", err.Error())
+		} else {
+			requestLog = w
 		}
 	}
 
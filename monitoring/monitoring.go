@@ -29,17 +29,41 @@ import (
 )
 
 var keyToItemIdMap = map[string]int{
+	"blocklist.allowed": -1,
+	"blocklist.error":   -1,
+	"blocklist.invalid": -1,
+	"blocklist.rules":   -1,
+	"cache.hit":         -1,
+	"cache.miss":        -1,
+	"cache.stale":       -1,
+	"localzone.error":   -1,
 	"panic.recover":     -1,
+	"query.any":         -1,
+	"query.blocked":     -1,
+	"query.collapsed":   -1,
+	"query.denied":      -1,
 	"query.doh.error":   -1,
 	"query.doh.forward": -1,
 	"query.doq.error":   -1,
 	"query.doq.forward": -1,
 	"query.dot.error":   -1,
 	"query.dot.forward": -1,
+	"query.local":       -1,
+	"query.localzone":   -1,
+	"query.prefetch":    -1,
+	"query.ratelimited": -1,
+	"query.rebind":      -1,
+	"query.retry":       -1,
+	"query.rpz":         -1,
+	"query.rrl":         -1,
+	"rpz.error":         -1,
 	"server.state":      -1,
 }
 
 var valMap = map[int]uint{}
+
+// gaugeMap holds values that are sent every time, rather than being reset after each send
+var gaugeMap = map[string]uint{}
 var valLock = &sync.Mutex{}
 var session *zbx.ActiveSession
 var log = logtic.Log.Connect("zabbix")
@@ -97,6 +121,11 @@ func Send() {
 	for id, value := range values {
 		strValues[id] = fmt.Sprintf("%d", value)
 	}
+	valLock.Lock()
+	for key, value := range gaugeMap {
+		strValues[keyToItemIdMap[key]] = fmt.Sprintf("%d", value)
+	}
+	valLock.Unlock()
 	// server.state is always 1
 	strValues[keyToItemIdMap["server.state"]] = "1"
 
@@ -128,6 +157,12 @@ func incrementValue(key string) {
 	valLock.Unlock()
 }
 
+func setGauge(key string, value uint) {
+	valLock.Lock()
+	gaugeMap[key] = value
+	valLock.Unlock()
+}
+
 func RecordPanicRecover() {
 	incrementValue("panic.recover")
 }
@@ -155,3 +190,117 @@ func RecordQueryDotError() {
 func RecordQueryDoqError() {
 	incrementValue("query.doq.error")
 }
+
+func RecordCacheHit() {
+	incrementValue("cache.hit")
+}
+
+func RecordCacheMiss() {
+	incrementValue("cache.miss")
+}
+
+func RecordCacheStale() {
+	incrementValue("cache.stale")
+}
+
+func RecordQueryAny() {
+	incrementValue("query.any")
+}
+
+func RecordQueryBlocked() {
+	incrementValue("query.blocked")
+}
+
+func RecordQueryDenied() {
+	incrementValue("query.denied")
+}
+
+func RecordQueryCollapsed() {
+	incrementValue("query.collapsed")
+}
+
+func RecordQueryLocal() {
+	incrementValue("query.local")
+}
+
+func RecordQueryLocalZone() {
+	incrementValue("query.localzone")
+}
+
+func RecordLocalZoneError() {
+	incrementValue("localzone.error")
+}
+
+func RecordQueryPrefetch() {
+	incrementValue("query.prefetch")
+}
+
+func RecordQueryRetry() {
+	incrementValue("query.retry")
+}
+
+func RecordQueryRateLimited() {
+	incrementValue("query.ratelimited")
+}
+
+func RecordQueryRebind() {
+	incrementValue("query.rebind")
+}
+
+func RecordQueryRRL() {
+	incrementValue("query.rrl")
+}
+
+func RecordQueryRPZ() {
+	incrementValue("query.rpz")
+}
+
+func RecordRPZError() {
+	incrementValue("rpz.error")
+}
+
+func RecordBlocklistError() {
+	incrementValue("blocklist.error")
+}
+
+// SetBlocklistRules sets the number of blocked and allowed domains loaded from the blocklist and
+// allowlist files, and the number of lines that could not be parsed.
+func SetBlocklistRules(blocked, allowed, invalid int) {
+	setGauge("blocklist.rules", uint(blocked))
+	setGauge("blocklist.allowed", uint(allowed))
+	setGauge("blocklist.invalid", uint(invalid))
+}
+
+// RegisterUpstream adds the per-upstream items for the given upstream server address. Must be
+// called before Setup.
+func RegisterUpstream(addr string) {
+	for _, key := range []string{upstreamQueryKey(addr), upstreamErrorKey(addr), upstreamTimeoutKey(addr)} {
+		if _, known := keyToItemIdMap[key]; !known {
+			keyToItemIdMap[key] = -1
+		}
+	}
+}
+
+func upstreamQueryKey(addr string) string {
+	return "upstream.query[" + addr + "]"
+}
+
+func upstreamErrorKey(addr string) string {
+	return "upstream.error[" + addr + "]"
+}
+
+func upstreamTimeoutKey(addr string) string {
+	return "upstream.timeout[" + addr + "]"
+}
+
+func RecordUpstreamQuery(addr string) {
+	incrementValue(upstreamQueryKey(addr))
+}
+
+func RecordUpstreamError(addr string) {
+	incrementValue(upstreamErrorKey(addr))
+}
+
+func RecordUpstreamTimeout(addr string) {
+	incrementValue(upstreamTimeoutKey(addr))
+}
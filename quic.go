@@ -132,7 +132,9 @@ func handleQuicConn(conn *quic.Conn, rw *quic.Stream) {
 	defer rw.Close()
 
 	if err := proxyDNSMessageWithLength(quicLog, "quic", conn.RemoteAddr().String(), rw); err != nil {
-		monitoring.RecordQueryDotError()
+		if err != errClientDenied && err != errRateLimited {
+			monitoring.RecordQueryDotError()
+		}
 		return
 	}
 	monitoring.RecordQueryDotForward()
@@ -0,0 +1,264 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"dnsproxy/monitoring"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	rateLimitRefused  = "refused"
+	rateLimitTruncate = "truncate"
+	rateLimitDrop     = "drop"
+)
+
+// rateLimitSweepInterval is how often idle clients are removed from a rate limiter
+const rateLimitSweepInterval = time.Minute
+
+// errRateLimited is returned when a query is not answered because the client is rate limited
+var errRateLimited = errors.New("client is rate limited")
+
+// tokenBucket is the rate limit state for a single client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter for many clients. Each client starts with a full
+// bucket of burst tokens that refills at rate tokens per second.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	lock      *sync.Mutex
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Allow takes a token from the bucket for the given key, returning false if the bucket is empty
+func (l *rateLimiter) Allow(key string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Len returns the number of clients being tracked
+func (l *rateLimiter) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.buckets)
+}
+
+// sweep removes buckets that would have refilled by now, as they are the same as a new bucket
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// queryLimiters are the per-client query rate limiters for each protocol
+var queryLimiters map[string]*rateLimiter
+
+// responseLimiter limits identical responses sent to each client (RRL), or nil if disabled
+var responseLimiter *rateLimiter
+
+// rateLimitedCount is the number of rate limited queries, used to sample log events
+var rateLimitedCount = &atomic.Uint64{}
+
+func setupRateLimits() {
+	queryLimiters = map[string]*rateLimiter{}
+	for proto, limit := range serverConfig.RateLimits {
+		if limit.QPS > 0 {
+			queryLimiters[proto] = newRateLimiter(limit.QPS, limit.Burst)
+		}
+	}
+	responseLimiter = nil
+	if serverConfig.RRLResponsesPerSecond > 0 {
+		responseLimiter = newRateLimiter(serverConfig.RRLResponsesPerSecond, serverConfig.RRLResponsesPerSecond)
+	}
+}
+
+// parseRateLimit parses a rate limit, which is a comma separated list of protocols or "*" for every
+// protocol, followed by the number of queries per second and optionally the burst size
+func parseRateLimit(value string) ([]string, tRateLimit, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, tRateLimit{}, fmt.Errorf("expected protocols, queries per second, and burst")
+	}
+
+	protocols := aclProtocols
+	if fields[0] != "*" {
+		protocols = []string{}
+		for _, proto := range parseList(fields[0]) {
+			proto = strings.ToLower(proto)
+			if !slices.Contains(aclProtocols, proto) {
+				return nil, tRateLimit{}, fmt.Errorf("unknown protocol %s", proto)
+			}
+			protocols = append(protocols, proto)
+		}
+	}
+
+	qps, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || qps < 0 {
+		return nil, tRateLimit{}, fmt.Errorf("invalid queries per second %s", fields[1])
+	}
+	limit := tRateLimit{QPS: qps, Burst: max(qps, 1)}
+	if len(fields) == 3 {
+		burst, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || burst < 1 {
+			return nil, tRateLimit{}, fmt.Errorf("invalid burst %s", fields[2])
+		}
+		limit.Burst = burst
+	}
+	return protocols, limit, nil
+}
+
+// clientPrefix returns the network used to identify the client with the given remote address, so
+// that a client can't avoid the rate limits by using many addresses from the same IPv6 network.
+func clientPrefix(remoteAddr string) string {
+	addr, ok := clientAddr(remoteAddr)
+	if !ok {
+		return remoteAddr
+	}
+	bits := serverConfig.RateLimitIPv4Prefix
+	if addr.Is6() {
+		bits = serverConfig.RateLimitIPv6Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
+// queryRateLimited returns true if the client with the given remote address has sent too many
+// queries over the given protocol
+func queryRateLimited(proto, remoteAddr string) bool {
+	limiter, ok := queryLimiters[proto]
+	if !ok {
+		return false
+	}
+	if limiter.Allow(clientPrefix(remoteAddr), time.Now()) {
+		return false
+	}
+	monitoring.RecordQueryRateLimited()
+	logRateLimited("Client rate limited", proto, remoteAddr)
+	return true
+}
+
+// responseRateLimited returns true if the client with the given remote address has been sent too
+// many identical replies, which are identified by the question and response code. Limited replies
+// are not sent. Every protocol served is connection-oriented, so there is no slip: a truncated reply
+// would only tell the client to retry over the connection it already used.
+// The message and reply MUST include a 2-byte big-endian length at the start.
+func responseRateLimited(proto, remoteAddr string, message, reply []byte) bool {
+	if responseLimiter == nil || len(reply) < 14 {
+		return false
+	}
+	q, ok := questionOf(message)
+	if !ok {
+		return false
+	}
+
+	key := fmt.Sprintf("%s|%s|%d|%d", clientPrefix(remoteAddr), strings.ToLower(q.Name.String()), q.Type, reply[5]&0x0f)
+	if responseLimiter.Allow(key, time.Now()) {
+		return false
+	}
+
+	monitoring.RecordQueryRRL()
+	logRateLimited("Response rate limited", proto, remoteAddr)
+	return true
+}
+
+// logRateLimited logs a rate limited query, sampling the events so that a flood of queries doesn't
+// flood the log
+func logRateLimited(msg, proto, remoteAddr string) {
+	count := rateLimitedCount.Add(1)
+	every := uint64(max(serverConfig.RateLimitLogEvery, 1))
+	if (count-1)%every != 0 {
+		return
+	}
+	log.PWarn(msg, map[string]any{
+		"proto":   proto,
+		"from_ip": remoteAddr,
+		"sampled": every,
+	})
+}
+
+// rateLimitedReply returns the reply to send to a rate limited client for the given action, or nil
+// if no reply should be sent.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func rateLimitedReply(message []byte, action string) []byte {
+	switch action {
+	case rateLimitRefused:
+		return buildErrorReply(message, dnsmessage.RCodeRefused, nil)
+	case rateLimitTruncate:
+		return truncatedReply(message)
+	}
+	return nil
+}
+
+// truncatedReply returns an empty reply to the given DNS message with the TC bit set, telling the
+// client to try again.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func truncatedReply(message []byte) []byte {
+	reply := buildErrorReply(message, dnsmessage.RCodeSuccess, nil)
+	if reply != nil {
+		reply[4] |= 0x02
+	}
+	return reply
+}
@@ -0,0 +1,163 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := range 3 {
+		if !limiter.Allow("a", now) {
+			t.Fatalf("Query %d within the burst was limited", i)
+		}
+	}
+	if limiter.Allow("a", now) {
+		t.Errorf("Query over the burst was allowed")
+	}
+	if !limiter.Allow("b", now) {
+		t.Errorf("Other client was limited")
+	}
+
+	// Two tokens are added each second
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow("a", now) {
+		t.Errorf("Query was limited after the bucket refilled")
+	}
+	if limiter.Allow("a", now) {
+		t.Errorf("Query was allowed before the bucket refilled")
+	}
+
+	// Clients with full buckets are removed
+	now = now.Add(2 * rateLimitSweepInterval)
+	limiter.Allow("c", now)
+	if limiter.Len() != 1 {
+		t.Errorf("Idle clients were not removed, %d clients remain", limiter.Len())
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	protocols, limit, err := parseRateLimit("tls,quic 10 25")
+	if err != nil {
+		t.Fatalf("Error parsing rate limit: %s", err.Error())
+	}
+	if len(protocols) != 2 || limit.QPS != 10 || limit.Burst != 25 {
+		t.Errorf("Unexpected rate limit %v %+v", protocols, limit)
+	}
+
+	protocols, limit, err = parseRateLimit("* 0.5")
+	if err != nil {
+		t.Fatalf("Error parsing rate limit: %s", err.Error())
+	}
+	if len(protocols) != len(aclProtocols) || limit.QPS != 0.5 || limit.Burst != 1 {
+		t.Errorf("Unexpected rate limit %v %+v", protocols, limit)
+	}
+
+	for _, value := range []string{"* ten", "udp 10", "* 10 0", "10", "* 10 20 30"} {
+		if _, _, err := parseRateLimit(value); err == nil {
+			t.Errorf("Invalid rate limit '%s' was accepted", value)
+		}
+	}
+}
+
+func TestClientPrefix(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"192.0.2.1:1234":            "192.0.2.1/32",
+		"[::ffff:192.0.2.1]:1234":   "192.0.2.1/32",
+		"[2001:db8:1:2:3::1]:1234":  "2001:db8:1::/56",
+		"[2001:db8:1:ff:3::1]:1234": "2001:db8:1::/56",
+		"[2001:db8:1:100::1]:1234":  "2001:db8:1:100::/56",
+		"not an address":            "not an address",
+	} {
+		if prefix := clientPrefix(addr); prefix != expected {
+			t.Errorf("Unexpected prefix for %s: %s", addr, prefix)
+		}
+	}
+}
+
+func TestResponseRateLimit(t *testing.T) {
+	t.Cleanup(setupRateLimits)
+	setTestConfig(t, func(config *tServerConfig) {
+		config.RRLResponsesPerSecond = 1
+	})
+	setupRateLimits()
+
+	query := buildTestQuery("example.com.", false)
+	reply := buildErrorReply(query, dnsmessage.RCodeSuccess, nil)
+	if responseRateLimited("tls", "192.0.2.1:1234", query, reply) {
+		t.Fatalf("First reply was limited")
+	}
+	if responseRateLimited("tls", "192.0.2.2:1234", query, reply) {
+		t.Errorf("Reply to another client was limited")
+	}
+	if responseRateLimited("tls", "192.0.2.1:1234", buildTestQuery("example.net.", false), reply) {
+		t.Errorf("Reply for another name was limited")
+	}
+	for range 4 {
+		if !responseRateLimited("tls", "192.0.2.1:1234", query, reply) {
+			t.Fatalf("Identical reply was not limited")
+		}
+	}
+
+	truncated := truncatedReply(query)
+	m := &dnsmessage.Message{}
+	if err := m.Unpack(truncated[2:]); err != nil {
+		t.Fatalf("Error parsing truncated reply: %s", err.Error())
+	}
+	if !m.Truncated || !m.Response || len(m.Answers) != 0 {
+		t.Errorf("Unexpected truncated reply %+v", m.Header)
+	}
+}
+
+func TestQueryRateLimit(t *testing.T) {
+	t.Cleanup(setupRateLimits)
+	setTestConfig(t, func(config *tServerConfig) {
+		config.RateLimits = map[string]tRateLimit{"https": {QPS: 0.001, Burst: 1}}
+	})
+	setupRateLimits()
+
+	if queryRateLimited("tls", "127.0.0.1:1234") || queryRateLimited("tls", "127.0.0.1:1234") {
+		t.Errorf("Query over a protocol without a limit was limited")
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	post := func() int {
+		resp, err := client.Post("https://127.0.0.1:8443/dns-query", "application/dns-message", bytes.NewBuffer([]byte{}))
+		if err != nil {
+			t.Fatalf("Error connecting to DOH: %s", err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(); status == 429 {
+		t.Errorf("First query was rate limited")
+	}
+	if status := post(); status != 429 {
+		t.Errorf("Unexpected HTTP response code %d", status)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"dnsproxy/monitoring"
+	"encoding/binary"
+	"net/netip"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	rebindProtectionOff    = "off"
+	rebindProtectionStrip  = "strip"
+	rebindProtectionRefuse = "refuse"
+)
+
+// cgnatPrefix is the shared address space used for carrier-grade NAT (RFC 6598)
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// rebindAllowedDomains are the domains that may resolve to internal addresses
+var rebindAllowedDomains *domainTrie
+
+func setupRebindProtection() {
+	rebindAllowedDomains = newDomainTrie()
+	for _, domain := range serverConfig.RebindAllowedDomains {
+		rebindAllowedDomains.Add(domain)
+	}
+}
+
+// isInternalAddr returns true if the given address is private, loopback, link-local, unspecified,
+// or in the CGNAT range, and so should never be the answer for a public name
+func isInternalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() || cgnatPrefix.Contains(addr)
+}
+
+// protectRebinding checks the reply to the given DNS message for addresses that could be used in a
+// DNS rebinding attack, where a public name resolves to an address on the clients network. Depending
+// on the configured protection these records are removed from the reply, or the reply is replaced
+// with REFUSED. Names within the allowed domains, and replies from response policy zones, are not
+// checked.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func protectRebinding(remoteAddr, upstream string, message, replyData []byte) []byte {
+	if serverConfig.RebindProtection == rebindProtectionOff || upstream == rpzUpstreamName {
+		return replyData
+	}
+
+	q, ok := questionOf(message)
+	if !ok || rebindAllowedDomains.Match(q.Name.String()) {
+		return replyData
+	}
+
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(replyData[2:]); err != nil {
+		return replyData
+	}
+
+	answers := []dnsmessage.Resource{}
+	blocked := []string{}
+	for _, rr := range reply.Answers {
+		var addr netip.Addr
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(body.AAAA)
+		}
+		if addr.IsValid() && isInternalAddr(addr) {
+			blocked = append(blocked, addr.String())
+			continue
+		}
+		answers = append(answers, rr)
+	}
+	if len(blocked) == 0 {
+		return replyData
+	}
+
+	monitoring.RecordQueryRebind()
+	log.PWarn("Blocked possible DNS rebinding answer", map[string]any{
+		"from_ip": remoteAddr,
+		"name":    q.Name.String(),
+		"type":    q.Type.String(),
+		"addrs":   blocked,
+		"action":  serverConfig.RebindProtection,
+	})
+
+	if serverConfig.RebindProtection == rebindProtectionRefuse {
+		return buildErrorReply(message, dnsmessage.RCodeRefused, &extendedError{code: edeFiltered, text: "answer contains an internal address"})
+	}
+
+	reply.Answers = answers
+	stripped, err := reply.AppendPack(make([]byte, 2, len(replyData)))
+	if err != nil {
+		return buildErrorReply(message, dnsmessage.RCodeRefused, &extendedError{code: edeFiltered, text: "answer contains an internal address"})
+	}
+	binary.BigEndian.PutUint16(stripped, uint16(len(stripped)-2))
+	return stripped
+}
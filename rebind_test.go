@@ -0,0 +1,128 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// buildTestAddrReply returns a reply for the given name with an A or AAAA record for each address
+func buildTestAddrReply(name string, addrs ...string) []byte {
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: 1234, Response: true, RecursionDesired: true, RecursionAvailable: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	builder.StartAnswers()
+	header := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: 60}
+	for _, s := range addrs {
+		addr := netip.MustParseAddr(s)
+		if addr.Is4() {
+			builder.AResource(header, dnsmessage.AResource{A: addr.As4()})
+		} else {
+			builder.AAAAResource(header, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+	}
+	message, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+	binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+	return message
+}
+
+func TestIsInternalAddr(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"127.0.0.1":       true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"100.127.255.255": true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fe80::1":         true,
+		"fd00::1":         true,
+		"::ffff:10.0.0.1": true,
+		"100.128.0.1":     false,
+		"192.0.2.1":       false,
+		"8.8.8.8":         false,
+		"2001:db8::1":     false,
+	} {
+		if isInternalAddr(netip.MustParseAddr(addr)) != expected {
+			t.Errorf("Unexpected result for %s, expected %v", addr, expected)
+		}
+	}
+}
+
+func TestProtectRebinding(t *testing.T) {
+	t.Cleanup(setupRebindProtection)
+	setTestConfig(t, func(config *tServerConfig) {
+		config.RebindAllowedDomains = []string{"corp.example"}
+	})
+	setupRebindProtection()
+
+	check := func(name string, addrs ...string) *dnsmessage.Message {
+		replyData := protectRebinding("127.0.0.1:1234", "upstream", buildTestQuery(name, false), buildTestAddrReply(name, addrs...))
+		reply := &dnsmessage.Message{}
+		if err := reply.Unpack(replyData[2:]); err != nil {
+			t.Fatalf("Error parsing reply: %s", err.Error())
+		}
+		return reply
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.RebindProtection = rebindProtectionOff
+	})
+	if reply := check("evil.example.", "10.0.0.1"); len(reply.Answers) != 1 {
+		t.Errorf("Reply was changed with protection off")
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.RebindProtection = rebindProtectionStrip
+	})
+	reply := check("evil.example.", "192.0.2.1", "10.0.0.1", "fe80::1")
+	if reply.RCode != dnsmessage.RCodeSuccess || reply.ID != 1234 || len(reply.Answers) != 1 {
+		t.Fatalf("Unexpected stripped reply %s %+v", reply.RCode, reply.Answers)
+	}
+	if reply.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("Public address was stripped")
+	}
+	if reply := check("host.corp.example.", "10.0.0.1"); len(reply.Answers) != 1 {
+		t.Errorf("Reply for an allowed domain was changed")
+	}
+
+	setTestConfig(t, func(config *tServerConfig) {
+		config.RebindProtection = rebindProtectionRefuse
+	})
+	if reply := check("evil.example.", "192.0.2.1", "127.0.0.1"); reply.RCode != dnsmessage.RCodeRefused || len(reply.Answers) != 0 {
+		t.Errorf("Unexpected refused reply %s %+v", reply.RCode, reply.Answers)
+	}
+	if reply := check("good.example.", "192.0.2.1"); reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 1 {
+		t.Errorf("Reply without internal addresses was changed")
+	}
+
+	replyData := buildTestAddrReply("local.example.", "10.0.0.1")
+	if protected := protectRebinding("127.0.0.1:1234", rpzUpstreamName, buildTestQuery("local.example.", false), replyData); len(protected) != len(replyData) {
+		t.Errorf("Response policy zone reply was changed")
+	}
+}
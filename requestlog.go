@@ -23,11 +23,9 @@ func (w *requestLogWriter) Open(filePath string) error {
 	if err != nil {
 		return err
 	}
-	w = &requestLogWriter{
-		f:        f,
-		filePath: filePath,
-		lock:     &sync.Mutex{},
-	}
+	w.f = f
+	w.filePath = filePath
+	w.lock = &sync.Mutex{}
 	return nil
 }
 
@@ -59,7 +57,7 @@ func (w *requestLogWriter) Close() {
 	w.lock.Unlock()
 }
 
-func (w *requestLogWriter) Record(proto, ip string, query, reply []byte) {
+func (w *requestLogWriter) Record(proto, ip, upstream string, query, reply []byte) {
 	values := []string{
 		time.Now().UTC().Format("2006-01-02T15:04:05-0700"),
 		csvEscape(serverConfig.ServerName),
@@ -67,6 +65,7 @@ func (w *requestLogWriter) Record(proto, ip string, query, reply []byte) {
 		csvEscape(ip),
 		fmt.Sprintf("%x", query),
 		fmt.Sprintf("%x", reply),
+		csvEscape(upstream),
 	}
 
 	line := []byte(strings.Join(values, ",") + "\n")
@@ -0,0 +1,45 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogUpstream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	w := &requestLogWriter{}
+	if err := w.Open(path); err != nil {
+		t.Fatalf("Error opening request log: %s", err.Error())
+	}
+	w.Record("tls", "127.0.0.1:1234", "udp://192.0.2.1:53", []byte{0x01}, []byte{0x02})
+	w.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading request log: %s", err.Error())
+	}
+	values := strings.Split(strings.TrimSpace(string(data)), ",")
+	if len(values) != 7 || values[6] != "udp://192.0.2.1:53" {
+		t.Errorf("Upstream server missing from request log line %q", data)
+	}
+}
@@ -0,0 +1,481 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"dnsproxy/monitoring"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// rpzUpstreamName is recorded as the upstream for queries answered by a response policy
+const rpzUpstreamName = "rpz"
+
+// errQueryDropped is returned when a response policy says that no reply should be sent
+var errQueryDropped = errors.New("query dropped by response policy")
+
+type rpzAction int
+
+const (
+	rpzActionNXDomain rpzAction = iota
+	rpzActionNoData
+	rpzActionPassthru
+	rpzActionDrop
+	rpzActionLocalData
+)
+
+// rpzRule is the action to take when a response policy trigger matches
+type rpzRule struct {
+	action rpzAction
+	// records are the local data to answer with
+	records []dnsmessage.Resource
+}
+
+// rpzZone is a Response Policy Zone. Triggers are stored as fully qualified names with the zone
+// name and trigger label removed.
+type rpzZone struct {
+	name             string
+	path             string
+	qnames           map[string]*rpzRule
+	qnameWildcards   map[string]*rpzRule
+	nsdnames         map[string]*rpzRule
+	nsdnameWildcards map[string]*rpzRule
+	// ips maps prefix lengths to prefixes of that length
+	ips map[int]map[netip.Prefix]*rpzRule
+	// ipBits are the prefix lengths in ips, longest first
+	ipBits []int
+}
+
+// rpzZones are the loaded response policy zones, in order of precedence. The set of zones is
+// replaced as a whole when the zone files are reloaded.
+var rpzZones = &atomic.Pointer[[]*rpzZone]{}
+
+// rpzWatcher reloads the response policy zone files when they change
+var rpzWatcher *fileWatcher
+
+func setupRPZ() error {
+	closeRPZ()
+	rpzZones.Store(nil)
+	if len(serverConfig.RPZZones) == 0 {
+		return nil
+	}
+
+	zones := []*rpzZone{}
+	paths := []string{}
+	for _, config := range serverConfig.RPZZones {
+		zone, err := loadRPZZone(config.Zone, config.Path)
+		if err != nil {
+			return fmt.Errorf("unable to load response policy zone %s: %s", config.Zone, err.Error())
+		}
+		zones = append(zones, zone)
+		paths = append(paths, config.Path)
+	}
+	rpzZones.Store(&zones)
+
+	watcher, err := newFileWatcher(paths, reloadRPZ)
+	if err != nil {
+		return fmt.Errorf("unable to watch response policy zone files: %s", err.Error())
+	}
+	rpzWatcher = watcher
+	return nil
+}
+
+func closeRPZ() {
+	if rpzWatcher != nil {
+		rpzWatcher.Close()
+		rpzWatcher = nil
+	}
+}
+
+// reloadRPZ loads the response policy zone files again. Zones that can't be loaded keep their
+// current rules.
+func reloadRPZ() {
+	current := rpzZones.Load()
+	if current == nil {
+		return
+	}
+
+	zones := make([]*rpzZone, len(*current))
+	for i, zone := range *current {
+		zones[i] = zone
+		reloaded, err := loadRPZZone(zone.name, zone.path)
+		if err != nil {
+			monitoring.RecordRPZError()
+			log.PError("Error reloading response policy zone, keeping the current rules", map[string]any{
+				"zone":  zone.name,
+				"path":  zone.path,
+				"error": err.Error(),
+			})
+			continue
+		}
+		zones[i] = reloaded
+	}
+	rpzZones.Store(&zones)
+}
+
+// loadRPZZone reads the Response Policy Zone with the given name from the zone file at the given
+// path. QNAME, Response-IP (rpz-ip) and NSDNAME (rpz-nsdname) triggers are supported, other
+// triggers are skipped.
+func loadRPZZone(name, path string) (*rpzZone, error) {
+	name = strings.ToLower(name)
+	records, err := parseZoneFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	zone := &rpzZone{
+		name:             name,
+		path:             path,
+		qnames:           map[string]*rpzRule{},
+		qnameWildcards:   map[string]*rpzRule{},
+		nsdnames:         map[string]*rpzRule{},
+		nsdnameWildcards: map[string]*rpzRule{},
+		ips:              map[int]map[netip.Prefix]*rpzRule{},
+	}
+
+	// Group the records by owner name, keeping the order from the file
+	owners := []string{}
+	byOwner := map[string][]dnsmessage.Resource{}
+	for _, rr := range records {
+		owner := rr.Header.Name.String()
+		if owner == name {
+			continue
+		}
+		if _, seen := byOwner[owner]; !seen {
+			owners = append(owners, owner)
+		}
+		byOwner[owner] = append(byOwner[owner], rr)
+	}
+
+	rules := 0
+	skipped := 0
+	for _, owner := range owners {
+		trigger, ok := strings.CutSuffix(owner, "."+name)
+		if !ok {
+			skipped++
+			continue
+		}
+		rule, err := newRPZRule(byOwner[owner])
+		if err == nil {
+			err = zone.addTrigger(trigger, rule)
+		}
+		if err != nil {
+			log.PWarn("Skipping response policy zone rule", map[string]any{
+				"zone":    name,
+				"trigger": trigger,
+				"error":   err.Error(),
+			})
+			skipped++
+			continue
+		}
+		rules++
+	}
+
+	slices.Sort(zone.ipBits)
+	slices.Reverse(zone.ipBits)
+
+	log.PInfo("Loaded response policy zone", map[string]any{
+		"zone":    name,
+		"path":    path,
+		"rules":   rules,
+		"skipped": skipped,
+	})
+	return zone, nil
+}
+
+// newRPZRule returns the rule for the given records, which all have the same owner name. A single
+// CNAME record to one of the special targets is an action, anything else is local data.
+func newRPZRule(records []dnsmessage.Resource) (*rpzRule, error) {
+	for _, rr := range records {
+		cname, ok := rr.Body.(*dnsmessage.CNAMEResource)
+		if !ok {
+			continue
+		}
+		action := rpzActionLocalData
+		switch target := cname.CNAME.String(); {
+		case target == ".":
+			action = rpzActionNXDomain
+		case target == "*.":
+			action = rpzActionNoData
+		case target == "rpz-passthru.":
+			action = rpzActionPassthru
+		case target == "rpz-drop.":
+			action = rpzActionDrop
+		case strings.HasPrefix(target, "rpz-"):
+			return nil, fmt.Errorf("unsupported action %s", target)
+		}
+		if len(records) > 1 {
+			return nil, fmt.Errorf("CNAME can't be combined with other records")
+		}
+		if action != rpzActionLocalData {
+			return &rpzRule{action: action}, nil
+		}
+	}
+	return &rpzRule{action: rpzActionLocalData, records: records}, nil
+}
+
+// addTrigger adds the rule for the given trigger, which is the owner name with the zone name removed
+func (z *rpzZone) addTrigger(trigger string, rule *rpzRule) error {
+	if ip, ok := strings.CutSuffix(trigger, ".rpz-ip"); ok {
+		prefix, err := parseRPZPrefix(ip)
+		if err != nil {
+			return err
+		}
+		bits := prefix.Bits()
+		if z.ips[bits] == nil {
+			z.ips[bits] = map[netip.Prefix]*rpzRule{}
+			z.ipBits = append(z.ipBits, bits)
+		}
+		z.ips[bits][prefix] = rule
+		return nil
+	}
+	if nsdname, ok := strings.CutSuffix(trigger, ".rpz-nsdname"); ok {
+		addNameTrigger(z.nsdnames, z.nsdnameWildcards, nsdname, rule)
+		return nil
+	}
+	for _, unsupported := range []string{".rpz-client-ip", ".rpz-nsip"} {
+		if strings.HasSuffix(trigger, unsupported) {
+			return fmt.Errorf("unsupported trigger %s", strings.TrimPrefix(unsupported, "."))
+		}
+	}
+	addNameTrigger(z.qnames, z.qnameWildcards, trigger, rule)
+	return nil
+}
+
+func addNameTrigger(names, wildcards map[string]*rpzRule, trigger string, rule *rpzRule) {
+	if base, ok := strings.CutPrefix(trigger, "*."); ok {
+		wildcards[base+"."] = rule
+		return
+	}
+	names[trigger+"."] = rule
+}
+
+// parseRPZPrefix parses the IP prefix from a Response-IP trigger, which is the prefix length
+// followed by the address in reverse order. IPv6 addresses use "zz" in place of "::".
+func parseRPZPrefix(trigger string) (netip.Prefix, error) {
+	labels := strings.Split(trigger, ".")
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil || len(labels) < 2 {
+		return netip.Prefix{}, fmt.Errorf("invalid rpz-ip trigger %s", trigger)
+	}
+	parts := labels[1:]
+	slices.Reverse(parts)
+
+	var addrText string
+	if len(parts) == 4 && !slices.Contains(parts, "zz") {
+		addrText = strings.Join(parts, ".")
+	} else {
+		addrText = strings.Join(parts, ":")
+		switch {
+		case addrText == "zz":
+			addrText = "::"
+		case strings.HasPrefix(addrText, "zz:"):
+			addrText = ":" + strings.TrimPrefix(addrText, "zz")
+		case strings.HasSuffix(addrText, ":zz"):
+			addrText = strings.TrimSuffix(addrText, "zz") + ":"
+		default:
+			addrText = strings.Replace(addrText, ":zz:", "::", 1)
+		}
+	}
+
+	addr, err := netip.ParseAddr(addrText)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid rpz-ip trigger %s", trigger)
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil || prefix.Addr() != addr {
+		return netip.Prefix{}, fmt.Errorf("invalid rpz-ip trigger %s", trigger)
+	}
+	return prefix, nil
+}
+
+// matchName returns the rule for the given name from the exact or wildcard triggers. Exact triggers
+// take precedence, followed by the most specific wildcard.
+func matchName(names, wildcards map[string]*rpzRule, name string) *rpzRule {
+	name = strings.ToLower(name)
+	if rule, ok := names[name]; ok {
+		return rule
+	}
+	for {
+		_, parent, found := strings.Cut(name, ".")
+		if !found || parent == "" {
+			return nil
+		}
+		if rule, ok := wildcards[parent]; ok {
+			return rule
+		}
+		name = parent
+	}
+}
+
+// matchIP returns the rule for the longest prefix that contains the given address
+func (z *rpzZone) matchIP(addr netip.Addr) *rpzRule {
+	for _, bits := range z.ipBits {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if rule, ok := z.ips[bits][prefix]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchReply returns the rule for the first address or name server in the reply that matches a
+// Response-IP or NSDNAME trigger
+func (z *rpzZone) matchReply(reply *dnsmessage.Message) *rpzRule {
+	if len(z.ipBits) > 0 {
+		for _, rr := range reply.Answers {
+			var addr netip.Addr
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addr = netip.AddrFrom4(body.A)
+			case *dnsmessage.AAAAResource:
+				addr = netip.AddrFrom16(body.AAAA)
+			default:
+				continue
+			}
+			if rule := z.matchIP(addr); rule != nil {
+				return rule
+			}
+		}
+	}
+
+	// Only the name servers included in the reply are known, as queries are forwarded rather than
+	// resolved recursively
+	if len(z.nsdnames) > 0 || len(z.nsdnameWildcards) > 0 {
+		for _, rr := range slices.Concat(reply.Answers, reply.Authorities) {
+			if ns, ok := rr.Body.(*dnsmessage.NSResource); ok {
+				if rule := matchName(z.nsdnames, z.nsdnameWildcards, ns.NS.String()); rule != nil {
+					return rule
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// resolveWithPolicy answers the given DNS message while applying the given response policy zones. QNAME
+// triggers are checked before the message is sent upstream, and Response-IP and NSDNAME triggers
+// are checked against the reply. The first zone with a matching trigger decides the action.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func resolveWithPolicy(message []byte, zones []*rpzZone) ([]byte, string, error) {
+	q, ok := questionOf(message)
+	if !ok {
+		return resolveCached(message)
+	}
+
+	for _, zone := range zones {
+		rule := matchName(zone.qnames, zone.qnameWildcards, q.Name.String())
+		if rule == nil {
+			continue
+		}
+		if rule.action == rpzActionPassthru {
+			return resolveCached(message)
+		}
+		return policyReply(message, q, zone, rule)
+	}
+
+	replyData, upstream, err := resolveCached(message)
+	if err != nil {
+		return nil, upstream, err
+	}
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(replyData[2:]); err != nil {
+		return replyData, upstream, nil
+	}
+	for _, zone := range zones {
+		rule := zone.matchReply(reply)
+		if rule == nil {
+			continue
+		}
+		if rule.action == rpzActionPassthru {
+			break
+		}
+		return policyReply(message, q, zone, rule)
+	}
+	return replyData, upstream, nil
+}
+
+// policyReply returns the reply to the given DNS message for a matching response policy rule
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func policyReply(message []byte, q dnsmessage.Question, zone *rpzZone, rule *rpzRule) ([]byte, string, error) {
+	monitoring.RecordQueryRPZ()
+	log.PDebug("Response policy matched", map[string]any{
+		"zone":   zone.name,
+		"name":   q.Name.String(),
+		"type":   q.Type.String(),
+		"action": int(rule.action),
+	})
+
+	ede := &extendedError{code: edeBlocked, text: "blocked by response policy zone " + zone.name}
+	switch rule.action {
+	case rpzActionDrop:
+		return nil, rpzUpstreamName, errQueryDropped
+	case rpzActionNXDomain:
+		return buildReply(message, localAnswer{rcode: dnsmessage.RCodeNameError, ede: ede}), rpzUpstreamName, nil
+	case rpzActionNoData:
+		return buildReply(message, localAnswer{rcode: dnsmessage.RCodeSuccess, ede: ede}), rpzUpstreamName, nil
+	}
+
+	answer := localAnswer{rcode: dnsmessage.RCodeSuccess, ede: &extendedError{code: edeFiltered, text: "answered by response policy zone " + zone.name}}
+	for _, rr := range rule.records {
+		if rr.Header.Type != q.Type && rr.Header.Type != dnsmessage.TypeCNAME {
+			continue
+		}
+		rr.Header.Name = q.Name
+		answer.answers = append(answer.answers, rr)
+		if cname, ok := rr.Body.(*dnsmessage.CNAMEResource); ok && q.Type != dnsmessage.TypeCNAME {
+			answer.answers = append(answer.answers, resolveCNAMETarget(cname.CNAME, q)...)
+		}
+	}
+	return buildReply(message, answer), rpzUpstreamName, nil
+}
+
+// resolveCNAMETarget returns the answers from the upstream servers for the target of a CNAME
+// record, or nothing if the query fails
+func resolveCNAMETarget(target dnsmessage.Name, q dnsmessage.Question) []dnsmessage.Resource {
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: target, Type: q.Type, Class: q.Class})
+	query, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	binary.BigEndian.PutUint16(query, uint16(len(query)-2))
+
+	replyData, _, err := resolveCached(query)
+	if err != nil {
+		return nil
+	}
+	reply := &dnsmessage.Message{}
+	if err := reply.Unpack(replyData[2:]); err != nil {
+		return nil
+	}
+	return reply.Answers
+}
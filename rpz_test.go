@@ -0,0 +1,198 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseRPZPrefix(t *testing.T) {
+	for trigger, expected := range map[string]string{
+		"32.1.2.0.192":            "192.0.2.1/32",
+		"24.0.2.0.192":            "192.0.2.0/24",
+		"128.1.zz.db8.2001":       "2001:db8::1/128",
+		"48.zz.db8.2001":          "2001:db8::/48",
+		"64.0.0.0.0.0.0.db8.2001": "2001:db8::/64",
+	} {
+		prefix, err := parseRPZPrefix(trigger)
+		if err != nil {
+			t.Errorf("Error parsing trigger %s: %s", trigger, err.Error())
+			continue
+		}
+		if prefix.String() != expected {
+			t.Errorf("Unexpected prefix for %s: %s", trigger, prefix.String())
+		}
+	}
+
+	for _, trigger := range []string{"1.2.0.192", "24.1.2.0.192", "x.1.2.0.192", "33.1.2.0.192"} {
+		if _, err := parseRPZPrefix(trigger); err == nil {
+			t.Errorf("Invalid trigger %s was accepted", trigger)
+		}
+	}
+}
+
+func TestResponsePolicyZone(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rpz.zone")
+	zone := `$TTL 300
+@	SOA localhost. root.localhost. 1 1h 15m 30d 2h
+	NS localhost.
+nx.example	CNAME .
+*.nx.example	CNAME .
+nodata.example	CNAME *.
+drop.example	CNAME rpz-drop.
+ok.nx.example	CNAME rpz-passthru.
+local.example	A 192.0.2.10
+	A 192.0.2.11
+	TXT "local"
+alias.example	CNAME target.example.
+24.0.2.0.198.rpz-ip	CNAME .
+32.1.2.0.198.rpz-ip	CNAME rpz-passthru.
+ns.bad.example.rpz-nsdname	CNAME .
+32.1.0.0.10.rpz-client-ip	CNAME .
+`
+	if err := os.WriteFile(path, []byte(zone), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+
+	currentUpstreams := upstreams
+	setTestConfig(t, func(config *tServerConfig) {
+		config.RPZZones = []tZoneFileConfig{{Zone: "rpz.test.", Path: path}}
+	})
+	t.Cleanup(func() {
+		upstreams = currentUpstreams
+		closeRPZ()
+		rpzZones.Store(nil)
+	})
+	if err := setupRPZ(); err != nil {
+		t.Fatalf("Error loading response policy zone: %s", err.Error())
+	}
+
+	group, err := newUpstreamGroup([]tUpstreamConfig{testUpstreamConfig(startEchoUpstream(t, nil))}, strategyPriority)
+	if err != nil {
+		t.Fatalf("Error setting up upstreams: %s", err.Error())
+	}
+	defer group.Close()
+	upstreams = group
+
+	query := func(name string) (*dnsmessage.Message, string) {
+		replyData, upstream, err := proxyDnsMessage(buildTestQuery(name, false))
+		if err != nil {
+			t.Fatalf("Error resolving %s: %s", name, err.Error())
+		}
+		reply := &dnsmessage.Message{}
+		if err := reply.Unpack(replyData[2:]); err != nil {
+			t.Fatalf("Error parsing reply: %s", err.Error())
+		}
+		return reply, upstream
+	}
+
+	for _, name := range []string{"nx.example.", "www.nx.example.", "a.b.NX.example."} {
+		if reply, upstream := query(name); reply.RCode != dnsmessage.RCodeNameError || upstream != rpzUpstreamName {
+			t.Errorf("Unexpected reply for %s: %s from %s", name, reply.RCode, upstream)
+		}
+	}
+
+	if reply, upstream := query("ok.nx.example."); reply.RCode != dnsmessage.RCodeSuccess || upstream == rpzUpstreamName {
+		t.Errorf("Passthru rule was not applied: %s from %s", reply.RCode, upstream)
+	}
+
+	if reply, _ := query("nodata.example."); reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 0 {
+		t.Errorf("Unexpected NODATA reply: %s %+v", reply.RCode, reply.Answers)
+	}
+
+	if _, _, err := proxyDnsMessage(buildTestQuery("drop.example.", false)); err != errQueryDropped {
+		t.Errorf("Query was not dropped: %v", err)
+	}
+
+	reply, _ := query("local.example.")
+	if len(reply.Answers) != 2 {
+		t.Fatalf("Unexpected local data answers %+v", reply.Answers)
+	}
+	for _, rr := range reply.Answers {
+		if rr.Header.Type != dnsmessage.TypeA || rr.Header.Name.String() != "local.example." {
+			t.Errorf("Unexpected local data record %+v", rr)
+		}
+	}
+
+	reply, _ = query("alias.example.")
+	if len(reply.Answers) < 1 || reply.Answers[0].Body.(*dnsmessage.CNAMEResource).CNAME.String() != "target.example." {
+		t.Errorf("Unexpected local data CNAME reply %+v", reply.Answers)
+	}
+
+	if reply, upstream := query("example.com."); reply.RCode != dnsmessage.RCodeSuccess || upstream == rpzUpstreamName {
+		t.Errorf("Unmatched name was changed: %s from %s", reply.RCode, upstream)
+	}
+
+	// Response-IP and NSDNAME triggers are matched against the reply from the upstream server
+	policy := (*rpzZones.Load())[0]
+	answer := func(addr string) *dnsmessage.Message {
+		return &dnsmessage.Message{Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.AResource{A: netip.MustParseAddr(addr).As4()},
+		}}}
+	}
+	if rule := policy.matchReply(answer("198.0.2.9")); rule == nil || rule.action != rpzActionNXDomain {
+		t.Errorf("Response-IP trigger did not match")
+	}
+	if rule := policy.matchReply(answer("198.0.2.1")); rule == nil || rule.action != rpzActionPassthru {
+		t.Errorf("Longest Response-IP prefix was not used")
+	}
+	if rule := policy.matchReply(answer("192.0.2.1")); rule != nil {
+		t.Errorf("Unexpected Response-IP match")
+	}
+
+	nsReply := &dnsmessage.Message{Authorities: []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns.bad.example.")},
+	}}}
+	if rule := policy.matchReply(nsReply); rule == nil || rule.action != rpzActionNXDomain {
+		t.Errorf("NSDNAME trigger did not match")
+	}
+
+	// The zone is reloaded when the file changes, and kept if the new file is invalid
+	if err := os.WriteFile(path, []byte(zone+"new.example\tCNAME .\n"), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+	reloaded := false
+	for range 100 {
+		if reply, upstream := query("new.example."); reply.RCode == dnsmessage.RCodeNameError && upstream == rpzUpstreamName {
+			reloaded = true
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !reloaded {
+		t.Fatalf("Zone was not reloaded after the file changed")
+	}
+
+	if err := os.WriteFile(path, []byte("bad.example\tA not-an-address\n"), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+	time.Sleep(2 * fileWatchDelay)
+	if reply, upstream := query("new.example."); reply.RCode != dnsmessage.RCodeNameError || upstream != rpzUpstreamName {
+		t.Errorf("Zone was replaced by an invalid zone file")
+	}
+}
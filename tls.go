@@ -95,7 +95,9 @@ func handleTlsConn(conn net.Conn) {
 	defer conn.Close()
 
 	if err := proxyDNSMessageWithLength(tlsLog, "tls", conn.RemoteAddr().String(), conn); err != nil {
-		monitoring.RecordQueryDotError()
+		if err != errClientDenied && err != errRateLimited {
+			monitoring.RecordQueryDotError()
+		}
 		return
 	}
 	monitoring.RecordQueryDotForward()
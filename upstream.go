@@ -0,0 +1,451 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"dnsproxy/monitoring"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	errNoUpstreams     = fmt.Errorf("no upstream servers available")
+	errUpstreamTimeout = fmt.Errorf("upstream server timed out")
+)
+
+const (
+	upstreamProtocolTCP   = "tcp"
+	upstreamProtocolUDP   = "udp"
+	upstreamProtocolTLS   = "tls"
+	upstreamProtocolHTTPS = "https"
+	upstreamProtocolQuic  = "quic"
+)
+
+const (
+	// upstreamRetryMin and upstreamRetryMax bound how long an unhealthy upstream server is skipped for
+	// before a query is sent to it again, when active health checks are disabled. The delay doubles
+	// each time the server fails.
+	upstreamRetryMin = 5 * time.Second
+	upstreamRetryMax = 5 * time.Minute
+)
+
+var upstreamProtocols = []string{upstreamProtocolTCP, upstreamProtocolUDP, upstreamProtocolTLS, upstreamProtocolHTTPS, upstreamProtocolQuic}
+
+// upstreamEncryptedProtocols are the protocols that support the TLS options
+var upstreamEncryptedProtocols = []string{upstreamProtocolTLS, upstreamProtocolHTTPS, upstreamProtocolQuic}
+
+// upstreamDefaultPorts are the ports used for upstream servers that don't specify one
+var upstreamDefaultPorts = map[string]string{
+	upstreamProtocolTCP:   "53",
+	upstreamProtocolUDP:   "53",
+	upstreamProtocolTLS:   "853",
+	upstreamProtocolHTTPS: "443",
+	upstreamProtocolQuic:  "853",
+}
+
+// upstreamLimits are the connection limits and timeouts used by upstream transports
+type upstreamLimits struct {
+	poolSize     int
+	idleTimeout  time.Duration
+	reconnects   int
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func upstreamLimitsFromConfig() upstreamLimits {
+	return upstreamLimits{
+		poolSize:     serverConfig.UpstreamPoolSize,
+		idleTimeout:  serverConfig.UpstreamIdleTimeout,
+		reconnects:   serverConfig.UpstreamReconnects,
+		dialTimeout:  serverConfig.UpstreamDialTimeout,
+		readTimeout:  serverConfig.UpstreamReadTimeout,
+		writeTimeout: serverConfig.UpstreamWriteTimeout,
+	}
+}
+
+// upstreamTransport sends DNS messages to an upstream server using a specific protocol
+type upstreamTransport interface {
+	// Exchange sends the given DNS message to the upstream server and returns its reply. The
+	// exchange is abandoned if the context is done before a reply is received.
+	// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+	Exchange(ctx context.Context, message []byte) ([]byte, error)
+	// Close will close any open connections to the upstream server
+	Close()
+}
+
+// upstream is a single upstream DNS server along with its health state
+type upstream struct {
+	addr      string
+	weight    int
+	transport upstreamTransport
+	lock      *sync.Mutex
+	healthy   bool
+	failures  int
+	latency   time.Duration
+	// passive is set when active health checks are disabled, in which case an unhealthy server is
+	// occasionally sent a query to see if it has recovered
+	passive    bool
+	retryDelay time.Duration
+	retryAt    time.Time
+}
+
+// upstreamGroup is a set of upstream DNS servers that queries can be sent to. Unhealthy servers are
+// skipped until they are re-admitted by a successful health check, or a successful query once their
+// retry delay has passed if health checks are disabled.
+type upstreamGroup struct {
+	upstreams []*upstream
+	strategy  string
+	next      *atomic.Uint64
+	stop      chan struct{}
+}
+
+func newUpstream(config tUpstreamConfig) (*upstream, error) {
+	limits := upstreamLimitsFromConfig()
+
+	var transport upstreamTransport
+	switch config.Protocol {
+	case upstreamProtocolUDP:
+		transport = newUDPTransport(config.Addr, serverConfig.UpstreamUDPBufferSize, limits)
+	case upstreamProtocolTLS:
+		tlsConfig, err := newUpstreamTLSConfig(config, nil)
+		if err != nil {
+			return nil, err
+		}
+		transport = newTLSPool(config.Addr, tlsConfig, limits)
+	case upstreamProtocolHTTPS:
+		tlsConfig, err := newUpstreamTLSConfig(config, nil)
+		if err != nil {
+			return nil, err
+		}
+		transport = newHTTPSTransport(config.Name, tlsConfig, limits)
+	case upstreamProtocolQuic:
+		tlsConfig, err := newUpstreamTLSConfig(config, []string{"doq"})
+		if err != nil {
+			return nil, err
+		}
+		transport = newQuicTransport(config.Addr, tlsConfig, limits)
+	default:
+		transport = newTCPPool(config.Addr, limits)
+	}
+
+	return &upstream{
+		addr:      config.Name,
+		weight:    config.Weight,
+		transport: transport,
+		lock:      &sync.Mutex{},
+		healthy:   true,
+		passive:   serverConfig.UpstreamHealthCheckInterval == 0,
+	}, nil
+}
+
+func newUpstreamGroup(configs []tUpstreamConfig, strategy string) (*upstreamGroup, error) {
+	g := &upstreamGroup{
+		strategy: strategy,
+		next:     &atomic.Uint64{},
+		stop:     make(chan struct{}),
+	}
+	for _, config := range configs {
+		u, err := newUpstream(config)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("unable to set up upstream server %s: %s", config.Name, err.Error())
+		}
+		g.upstreams = append(g.upstreams, u)
+	}
+
+	if serverConfig.UpstreamHealthCheckInterval > 0 {
+		go g.healthCheckLoop(serverConfig.UpstreamHealthCheckInterval)
+	}
+
+	return g, nil
+}
+
+// Exchange sends the given DNS message to a healthy upstream server chosen by the groups strategy.
+// If there is an error, or the server replies with SERVFAIL, the query is retried on the next server
+// up to the configured number of retries, so long as the total query time hasn't elapsed. If every
+// server is unhealthy they are all tried anyway. If racing is enabled the query is instead sent to
+// several servers at once and the first good reply is used. Returns the reply and the server that
+// provided it.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func (g *upstreamGroup) Exchange(ctx context.Context, message []byte) ([]byte, *upstream, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverConfig.UpstreamQueryTimeout)
+	defer cancel()
+
+	candidates := g.healthyUpstreams()
+	if len(candidates) == 0 {
+		candidates = g.upstreams
+	}
+	ordered := g.order(candidates)
+	if serverConfig.UpstreamRaceCount > 1 && len(ordered) > 1 {
+		return g.race(ctx, ordered[:min(len(ordered), serverConfig.UpstreamRaceCount)], message)
+	}
+	attempts := min(len(ordered), 1+serverConfig.UpstreamRetries)
+
+	var lastErr error = errNoUpstreams
+	var servfailReply []byte
+	var servfailUpstream *upstream
+	for i, u := range ordered[:attempts] {
+		if i > 0 {
+			monitoring.RecordQueryRetry()
+			log.PDebug("Retrying query on next upstream server", map[string]any{
+				"upstream": u.addr,
+				"attempt":  i + 1,
+				"error":    lastErr.Error(),
+			})
+		}
+
+		reply, err := g.exchangeWith(ctx, u, message)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		if serverConfig.UpstreamRetryServfail && isServfail(reply) {
+			lastErr = fmt.Errorf("upstream server %s replied with SERVFAIL", u.addr)
+			servfailReply = reply
+			servfailUpstream = u
+			continue
+		}
+
+		return reply, u, nil
+	}
+
+	// Every upstream server that was tried replied with SERVFAIL or failed, pass on the SERVFAIL
+	if servfailReply != nil {
+		return servfailReply, servfailUpstream, nil
+	}
+
+	if ctx.Err() != nil && errors.Is(lastErr, context.DeadlineExceeded) {
+		lastErr = fmt.Errorf("query timed out after %s", serverConfig.UpstreamQueryTimeout)
+	}
+	return nil, nil, lastErr
+}
+
+// exchangeWith sends the given DNS message to a single upstream server, recording the outcome
+func (g *upstreamGroup) exchangeWith(ctx context.Context, u *upstream, message []byte) ([]byte, error) {
+	start := time.Now()
+	reply, err := u.transport.Exchange(ctx, message)
+	if err != nil {
+		if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			// The query was abandoned, which says nothing about the health of the upstream server
+			return nil, err
+		}
+		if isTimeout(err) {
+			monitoring.RecordUpstreamTimeout(u.addr)
+			log.PWarn("Upstream server timed out", map[string]any{
+				"upstream": u.addr,
+				"elapsed":  time.Since(start).String(),
+				"error":    err.Error(),
+			})
+		} else {
+			monitoring.RecordUpstreamError(u.addr)
+		}
+		u.recordFailure(err)
+		return nil, err
+	}
+
+	monitoring.RecordUpstreamQuery(u.addr)
+	u.recordSuccess(time.Since(start))
+	return reply, nil
+}
+
+// Close stops health checks and closes all connections to the upstream servers
+func (g *upstreamGroup) Close() {
+	close(g.stop)
+	for _, u := range g.upstreams {
+		u.transport.Close()
+	}
+}
+
+func (g *upstreamGroup) healthyUpstreams() []*upstream {
+	healthy := make([]*upstream, 0, len(g.upstreams))
+	for _, u := range g.upstreams {
+		if u.isHealthy() || u.shouldRetry() {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+func (g *upstreamGroup) healthCheckLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			for _, u := range g.upstreams {
+				go u.healthCheck()
+			}
+		}
+	}
+}
+
+func (u *upstream) isHealthy() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.healthy
+}
+
+// shouldRetry returns true if the unhealthy server should be sent a query to see if it has recovered.
+// Only one query is let through each time the retry delay passes.
+func (u *upstream) shouldRetry() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.healthy || !u.passive || time.Now().Before(u.retryAt) {
+		return false
+	}
+	u.retryAt = time.Now().Add(u.retryDelay)
+	return true
+}
+
+func (u *upstream) averageLatency() time.Duration {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.latency
+}
+
+func (u *upstream) recordSuccess(latency time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.latency == 0 {
+		u.latency = latency
+	} else {
+		u.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(u.latency))
+	}
+	u.failures = 0
+	u.retryDelay = 0
+	if !u.healthy {
+		u.healthy = true
+		log.PWarn("Upstream server is healthy again", map[string]any{
+			"upstream": u.addr,
+		})
+	}
+}
+
+func (u *upstream) recordFailure(err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.failures++
+	if u.healthy && u.failures >= serverConfig.UpstreamMaxFails {
+		u.healthy = false
+		log.PError("Upstream server marked unhealthy", map[string]any{
+			"upstream": u.addr,
+			"failures": u.failures,
+			"error":    err.Error(),
+		})
+	}
+
+	if !u.healthy && u.passive {
+		u.retryDelay = min(max(u.retryDelay*2, upstreamRetryMin), upstreamRetryMax)
+		u.retryAt = time.Now().Add(u.retryDelay)
+	}
+}
+
+// healthCheck sends a query for the configured health check name to the upstream server. Any reply
+// other than SERVFAIL or REFUSED is considered healthy.
+func (u *upstream) healthCheck() {
+	message, err := buildHealthCheckQuery()
+	if err != nil {
+		log.Error("Unable to build health check query: %s", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.UpstreamHealthCheckInterval)
+	defer cancel()
+
+	start := time.Now()
+	reply, err := u.transport.Exchange(ctx, message)
+	if err != nil {
+		u.recordFailure(err)
+		return
+	}
+
+	if isServfail(reply) || isRefused(reply) {
+		u.recordFailure(fmt.Errorf("health check returned an error"))
+		return
+	}
+	u.recordSuccess(time.Since(start))
+}
+
+func buildHealthCheckQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(serverConfig.UpstreamHealthCheckName)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{
+		ID:               uint16(mathrand.UintN(65536)),
+		RecursionDesired: true,
+	})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  dnsmessage.TypeNS,
+		Class: dnsmessage.ClassINET,
+	})
+	message, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+	return message, nil
+}
+
+// isTimeout returns true if the error was caused by an upstream server not replying in time
+func isTimeout(err error) bool {
+	if errors.Is(err, errUpstreamTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func replyRCode(reply []byte) dnsmessage.RCode {
+	if len(reply) < 6 {
+		return dnsmessage.RCodeFormatError
+	}
+	return dnsmessage.RCode(reply[5] & 0x0f)
+}
+
+func isServfail(reply []byte) bool {
+	return replyRCode(reply) == dnsmessage.RCodeServerFailure
+}
+
+func isRefused(reply []byte) bool {
+	return replyRCode(reply) == dnsmessage.RCodeRefused
+}
@@ -0,0 +1,109 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// httpsTransport sends queries to a DNS over HTTPS upstream server (RFC 8484). Connections are
+// kept open and reused, with many queries sent at once over HTTP/2 where the server supports it.
+type httpsTransport struct {
+	url       string
+	transport *http.Transport
+	client    *http.Client
+}
+
+func newHTTPSTransport(url string, tlsConfig *tls.Config, limits upstreamLimits) *httpsTransport {
+	transport := &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: limits.dialTimeout}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   limits.dialTimeout,
+		ResponseHeaderTimeout: limits.readTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   limits.poolSize,
+		IdleConnTimeout:       limits.idleTimeout,
+	}
+
+	return &httpsTransport{
+		url:       url,
+		transport: transport,
+		client:    &http.Client{Transport: transport},
+	}
+}
+
+// Exchange sends the given DNS message to the upstream server as a POST request and returns its reply.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func (t *httpsTransport) Exchange(ctx context.Context, message []byte) ([]byte, error) {
+	if len(message) < 14 {
+		return nil, errMessageTooShort
+	}
+
+	// Use a message ID of 0 to make requests more cache friendly, as recommended by RFC 8484
+	query := make([]byte, len(message)-2)
+	copy(query, message[2:])
+	query[0], query[1] = 0, 0
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("User-Agent", "dnsproxy/"+Version)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected http response %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/dns-message" {
+		return nil, fmt.Errorf("unexpected http response content type %s", contentType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 12 {
+		return nil, errMessageTooShort
+	}
+
+	reply := make([]byte, 2+len(body))
+	binary.BigEndian.PutUint16(reply, uint16(len(body)))
+	copy(reply[2:], body)
+	// Restore the message ID the client used
+	copy(reply[2:4], message[2:4])
+	return reply, nil
+}
+
+func (t *httpsTransport) Close() {
+	t.transport.CloseIdleConnections()
+}
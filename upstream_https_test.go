@@ -0,0 +1,97 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPSUpstream(t *testing.T) {
+	dir := t.TempDir()
+	certPath := path.Join(dir, "localhost.crt")
+	keyPath := path.Join(dir, "localhost.key")
+	generateTestCert(certPath, keyPath)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	http2Requests := &atomic.Int32{}
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			rw.WriteHeader(400)
+			return
+		}
+		if r.ProtoMajor == 2 {
+			http2Requests.Add(1)
+		}
+		message, _ := io.ReadAll(r.Body)
+		if binary.BigEndian.Uint16(message) != 0 {
+			rw.WriteHeader(400)
+			return
+		}
+		message[2] |= 0x80
+		rw.Header().Set("Content-Type", "application/dns-message")
+		rw.Write(message)
+	})}
+	go server.ServeTLS(l, certPath, keyPath)
+	t.Cleanup(func() { server.Close() })
+
+	config, err := parseUpstreamConfig("https://" + l.Addr().String() + "/dns-query ca=" + certPath)
+	if err != nil {
+		t.Fatalf("Error parsing upstream config: %s", err.Error())
+	}
+	tlsConfig, err := newUpstreamTLSConfig(config, nil)
+	if err != nil {
+		t.Fatalf("Error setting up TLS config: %s", err.Error())
+	}
+	transport := newHTTPSTransport(config.Name, tlsConfig, testLimits(1, time.Minute, 0))
+	defer transport.Close()
+
+	message := testQuery()
+	reply, err := transport.Exchange(context.Background(), message)
+	if err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+	if !bytes.Equal(reply[:4], message[:4]) {
+		t.Errorf("Unexpected length or message ID in reply")
+	}
+	if !bytes.Equal(reply[5:], message[5:]) {
+		t.Errorf("Reply does not match query")
+	}
+	if http2Requests.Load() != 1 {
+		t.Errorf("Request was not made using HTTP/2")
+	}
+
+	config, _ = parseUpstreamConfig("https://" + l.Addr().String() + "/not-found ca=" + certPath)
+	transport = newHTTPSTransport(config.Name, tlsConfig, testLimits(1, time.Minute, 0))
+	defer transport.Close()
+	if _, err := transport.Exchange(context.Background(), message); err == nil {
+		t.Errorf("No error seen for HTTP error response")
+	}
+}
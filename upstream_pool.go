@@ -0,0 +1,406 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errPoolClosed      = fmt.Errorf("upstream connection pool closed")
+	errConnIdle        = fmt.Errorf("upstream connection idle")
+	errConnTimedOut    = fmt.Errorf("upstream connection stopped replying")
+	errConnBusy        = fmt.Errorf("no free message IDs on upstream connection")
+	errMessageTooShort = fmt.Errorf("dns message too short")
+)
+
+// maxConnTimeouts is the number of queries in a row that may time out on a connection before it is
+// assumed to be dead and closed, so that later queries are sent on a new connection
+const maxConnTimeouts = 2
+
+// tcpPool maintains a set of long-lived connections to a single upstream DNS server. Many queries
+// can be in-flight on a connection at once (RFC 7766 pipelining); each query is sent with a message
+// ID unique to its connection and replies are matched back to the query using that ID.
+type tcpPool struct {
+	addr   string
+	limits upstreamLimits
+	dial   func(ctx context.Context) (net.Conn, error)
+
+	lock    *sync.Mutex
+	conns   []*pipelinedConn
+	dialing int
+	closed  bool
+	// dialed is closed, and replaced, whenever a dial finishes
+	dialed chan struct{}
+}
+
+type pipelinedConn struct {
+	pool      *tcpPool
+	conn      net.Conn
+	writeLock *sync.Mutex
+	lock      *sync.Mutex
+	pending   map[uint16]chan []byte
+	idleTimer *time.Timer
+	timeouts  int
+	err       error
+}
+
+func newTCPPool(addr string, limits upstreamLimits) *tcpPool {
+	dialer := &net.Dialer{Timeout: limits.dialTimeout}
+	p := &tcpPool{
+		addr:   addr,
+		limits: limits,
+		dial: func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		},
+		lock:   &sync.Mutex{},
+		dialed: make(chan struct{}),
+	}
+	return p
+}
+
+// Exchange sends the given DNS message to the upstream server and returns its reply.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+//
+// If the connection the query was sent on fails before a reply is received the query is sent again
+// on a new connection, up to the configured number of reconnect attempts. Queries that time out are
+// not sent again.
+func (p *tcpPool) Exchange(ctx context.Context, message []byte) ([]byte, error) {
+	if len(message) < 4 {
+		return nil, errMessageTooShort
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= p.limits.reconnects; attempt++ {
+		c, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := c.exchange(ctx, message)
+		if err == nil {
+			return reply, nil
+		}
+		if isTimeout(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+		log.PDebug("Upstream connection failed, reconnecting", map[string]any{
+			"upstream": p.addr,
+			"attempt":  attempt + 1,
+			"error":    err.Error(),
+		})
+	}
+
+	return nil, lastErr
+}
+
+// Close will close all open connections to the upstream server. Any pending queries will fail.
+func (p *tcpPool) Close() {
+	p.lock.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	p.lock.Unlock()
+
+	for _, c := range conns {
+		c.close(errPoolClosed)
+	}
+}
+
+// get returns a connection to use for a query. Idle connections are preferred, then a new
+// connection is opened if the pool has room, otherwise the least busy connection is used.
+func (p *tcpPool) get(ctx context.Context) (*pipelinedConn, error) {
+	p.lock.Lock()
+	var best *pipelinedConn
+	for {
+		if p.closed {
+			p.lock.Unlock()
+			return nil, errPoolClosed
+		}
+
+		best = nil
+		bestPending := 0
+		for _, c := range p.conns {
+			n := c.inFlight()
+			if best == nil || n < bestPending {
+				best = c
+				bestPending = n
+			}
+		}
+
+		full := len(p.conns)+p.dialing >= p.limits.poolSize
+		if best != nil && (bestPending == 0 || full) {
+			p.lock.Unlock()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		// Every slot in the pool is taken by a connection that is still being dialed
+		dialed := p.dialed
+		p.lock.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.lock.Lock()
+	}
+
+	p.dialing++
+	p.lock.Unlock()
+
+	conn, err := p.dial(ctx)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	if p.closed {
+		conn.Close()
+		return nil, errPoolClosed
+	}
+
+	c := &pipelinedConn{
+		pool:      p,
+		conn:      conn,
+		writeLock: &sync.Mutex{},
+		lock:      &sync.Mutex{},
+		pending:   map[uint16]chan []byte{},
+	}
+	c.idleTimer = time.AfterFunc(p.limits.idleTimeout, c.closeIfIdle)
+	p.conns = append(p.conns, c)
+	go c.readLoop()
+
+	log.PDebug("Opened upstream connection", map[string]any{
+		"upstream":    p.addr,
+		"local_addr":  conn.LocalAddr().String(),
+		"connections": len(p.conns),
+	})
+
+	return c, nil
+}
+
+func (p *tcpPool) remove(c *pipelinedConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, conn := range p.conns {
+		if conn == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *pipelinedConn) inFlight() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.pending)
+}
+
+func (c *pipelinedConn) exchange(ctx context.Context, message []byte) ([]byte, error) {
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	if len(c.pending) >= 65536 {
+		c.lock.Unlock()
+		return nil, errConnBusy
+	}
+	id := uint16(mathrand.UintN(65536))
+	for {
+		if _, inUse := c.pending[id]; !inUse {
+			break
+		}
+		id++
+	}
+	replyCh := make(chan []byte, 1)
+	c.pending[id] = replyCh
+	c.idleTimer.Stop()
+	c.lock.Unlock()
+
+	query := make([]byte, len(message))
+	copy(query, message)
+	binary.BigEndian.PutUint16(query[2:4], id)
+
+	c.writeLock.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.pool.limits.writeTimeout))
+	_, err := c.conn.Write(query)
+	c.writeLock.Unlock()
+	if err != nil {
+		// A failed write leaves the stream in an unknown state, so the connection can't be reused
+		c.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(c.pool.limits.readTimeout)
+	defer timer.Stop()
+
+	select {
+	case reply, ok := <-replyCh:
+		if !ok {
+			c.lock.Lock()
+			err := c.err
+			c.lock.Unlock()
+			return nil, err
+		}
+
+		// Restore the message ID the client used
+		copy(reply[2:4], message[2:4])
+		return reply, nil
+	case <-timer.C:
+		c.timedOut(id)
+		return nil, errUpstreamTimeout
+	case <-ctx.Done():
+		c.cancel(id)
+		return nil, ctx.Err()
+	}
+}
+
+// cancel stops waiting for the reply to the query with the given ID. If the reply arrives later it
+// is discarded.
+func (c *pipelinedConn) cancel(id uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.pending, id)
+	if len(c.pending) == 0 && c.err == nil {
+		c.idleTimer.Reset(c.pool.limits.idleTimeout)
+	}
+}
+
+// timedOut stops waiting for the reply to the query with the given ID, closing the connection if too
+// many queries in a row have gone unanswered.
+func (c *pipelinedConn) timedOut(id uint16) {
+	c.lock.Lock()
+	c.timeouts++
+	dead := c.timeouts >= maxConnTimeouts
+	c.lock.Unlock()
+
+	if dead {
+		c.close(errConnTimedOut)
+		return
+	}
+	c.cancel(id)
+}
+
+func (c *pipelinedConn) readLoop() {
+	for {
+		// Idle connections are closed by the idle timer, so a connection that has received nothing for
+		// longer than that plus the read timeout has stopped replying
+		c.conn.SetReadDeadline(time.Now().Add(c.pool.limits.idleTimeout + c.pool.limits.readTimeout))
+
+		rawSize := make([]byte, 2)
+		if _, err := io.ReadFull(c.conn, rawSize); err != nil {
+			c.close(err)
+			return
+		}
+
+		size := binary.BigEndian.Uint16(rawSize)
+		reply := make([]byte, 2+int(size))
+		copy(reply, rawSize)
+		if _, err := io.ReadFull(c.conn, reply[2:]); err != nil {
+			c.close(err)
+			return
+		}
+		if size < 2 {
+			continue
+		}
+
+		id := binary.BigEndian.Uint16(reply[2:4])
+		c.lock.Lock()
+		replyCh, known := c.pending[id]
+		delete(c.pending, id)
+		if known {
+			c.timeouts = 0
+		}
+		if len(c.pending) == 0 && c.err == nil {
+			c.idleTimer.Reset(c.pool.limits.idleTimeout)
+		}
+		c.lock.Unlock()
+
+		if !known {
+			log.PDebug("Discarding unexpected reply from upstream", map[string]any{
+				"upstream": c.pool.addr,
+				"id":       id,
+			})
+			continue
+		}
+		replyCh <- reply
+	}
+}
+
+func (c *pipelinedConn) closeIfIdle() {
+	c.lock.Lock()
+	idle := len(c.pending) == 0
+	c.lock.Unlock()
+
+	if idle {
+		c.close(errConnIdle)
+	}
+}
+
+// close will close the connection and fail any pending queries. It is safe to call more than once.
+func (c *pipelinedConn) close(err error) {
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return
+	}
+	c.err = err
+	c.idleTimer.Stop()
+	pending := c.pending
+	c.pending = map[uint16]chan []byte{}
+	c.lock.Unlock()
+
+	c.pool.remove(c)
+	c.conn.Close()
+	for _, replyCh := range pending {
+		close(replyCh)
+	}
+
+	if err != errConnIdle && err != errPoolClosed {
+		log.PDebug("Closed upstream connection", map[string]any{
+			"upstream": c.pool.addr,
+			"pending":  len(pending),
+			"error":    err.Error(),
+		})
+	}
+}
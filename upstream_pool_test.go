@@ -0,0 +1,261 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLimits returns upstream limits with short timeouts, suitable for tests
+func testLimits(size int, idleTimeout time.Duration, reconnects int) upstreamLimits {
+	return upstreamLimits{
+		poolSize:     size,
+		idleTimeout:  idleTimeout,
+		reconnects:   reconnects,
+		dialTimeout:  time.Second,
+		readTimeout:  time.Second,
+		writeTimeout: time.Second,
+	}
+}
+
+// startEchoUpstream starts a DNS-over-TCP server that replies to every query by echoing it back
+// with the QR bit set. Replies are sent after a random delay, so they arrive out of order when
+// queries are pipelined. The number of accepted connections is written to conns.
+func startEchoUpstream(t *testing.T, conns *atomic.Int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go serveEcho(l, conns)
+	return l.Addr().String()
+}
+
+func serveEcho(l net.Listener, conns *atomic.Int32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if conns != nil {
+			conns.Add(1)
+		}
+		go func() {
+			defer conn.Close()
+			writeLock := &sync.Mutex{}
+			for {
+				message := make([]byte, 2)
+				if _, err := io.ReadFull(conn, message); err != nil {
+					return
+				}
+				message = append(message, make([]byte, binary.BigEndian.Uint16(message))...)
+				if _, err := io.ReadFull(conn, message[2:]); err != nil {
+					return
+				}
+				go func() {
+					time.Sleep(time.Duration(mathrand.IntN(5)) * time.Millisecond)
+					message[4] |= 0x80
+					writeLock.Lock()
+					conn.Write(message)
+					writeLock.Unlock()
+				}()
+			}
+		}()
+	}
+}
+
+func TestTCPPoolPipelining(t *testing.T) {
+	conns := &atomic.Int32{}
+	addr := startEchoUpstream(t, conns)
+
+	pool := newTCPPool(addr, testLimits(2, time.Minute, 1))
+	defer pool.Close()
+
+	wg := &sync.WaitGroup{}
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			message := make([]byte, 2+len(dnsMessage))
+			binary.BigEndian.PutUint16(message, uint16(len(dnsMessage)))
+			copy(message[2:], dnsMessage)
+			binary.BigEndian.PutUint16(message[2:4], uint16(i))
+
+			reply, err := pool.Exchange(context.Background(), message)
+			if err != nil {
+				t.Errorf("Error exchanging message: %s", err.Error())
+				return
+			}
+			if id := binary.BigEndian.Uint16(reply[2:4]); id != uint16(i) {
+				t.Errorf("Unexpected message ID in reply. Expected %d got %d", i, id)
+			}
+			if !bytes.Equal(reply[5:], message[5:]) {
+				t.Errorf("Reply does not match query")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := conns.Load(); n > 2 {
+		t.Errorf("Unexpected number of upstream connections. Expected at most 2 got %d", n)
+	}
+}
+
+func TestTCPPoolIdleTimeout(t *testing.T) {
+	conns := &atomic.Int32{}
+	addr := startEchoUpstream(t, conns)
+
+	pool := newTCPPool(addr, testLimits(1, 50*time.Millisecond, 1))
+	defer pool.Close()
+
+	message := make([]byte, 2+len(dnsMessage))
+	binary.BigEndian.PutUint16(message, uint16(len(dnsMessage)))
+	copy(message[2:], dnsMessage)
+
+	if _, err := pool.Exchange(context.Background(), message); err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := pool.Exchange(context.Background(), message); err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+
+	if n := conns.Load(); n != 2 {
+		t.Errorf("Unexpected number of upstream connections. Expected 2 got %d", n)
+	}
+}
+
+func TestTCPPoolUnresponsiveUpstream(t *testing.T) {
+	limits := testLimits(1, time.Minute, 0)
+	limits.readTimeout = 20 * time.Millisecond
+	pool := newTCPPool(startSilentUpstream(t), limits)
+	defer pool.Close()
+
+	dials := &atomic.Int32{}
+	dial := pool.dial
+	pool.dial = func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		return dial(ctx)
+	}
+
+	message := make([]byte, 2+len(dnsMessage))
+	binary.BigEndian.PutUint16(message, uint16(len(dnsMessage)))
+	copy(message[2:], dnsMessage)
+
+	for range maxConnTimeouts {
+		if _, err := pool.Exchange(context.Background(), message); err != errUpstreamTimeout {
+			t.Fatalf("Unexpected error exchanging message. Expected %v got %v", errUpstreamTimeout, err)
+		}
+	}
+
+	pool.lock.Lock()
+	n := len(pool.conns)
+	pool.lock.Unlock()
+	if n != 0 {
+		t.Errorf("Unresponsive connection not removed from pool. Expected 0 connections got %d", n)
+	}
+
+	pool.Exchange(context.Background(), message)
+	if n := dials.Load(); n != 2 {
+		t.Errorf("Unexpected number of upstream connections. Expected 2 got %d", n)
+	}
+}
+
+func TestTCPPoolReadDeadline(t *testing.T) {
+	limits := testLimits(1, 50*time.Millisecond, 0)
+	limits.readTimeout = 50 * time.Millisecond
+	pool := newTCPPool(startSilentUpstream(t), limits)
+	defer pool.Close()
+
+	c, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatalf("Error opening connection: %s", err.Error())
+	}
+	// Hold the connection open as though a query were in flight, so the idle timer won't close it
+	c.lock.Lock()
+	c.pending[1] = make(chan []byte, 1)
+	c.idleTimer.Stop()
+	c.lock.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+
+	c.lock.Lock()
+	err = c.err
+	c.lock.Unlock()
+	if err == nil {
+		t.Errorf("Connection without any reads not closed")
+	}
+}
+
+func TestTCPPoolDialWaitCancelled(t *testing.T) {
+	pool := newTCPPool(startSilentUpstream(t), testLimits(1, time.Minute, 0))
+	defer pool.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	dial := pool.dial
+	pool.dial = func(ctx context.Context) (net.Conn, error) {
+		<-release
+		return dial(ctx)
+	}
+
+	// The first query takes the only slot in the pool and is stuck dialing
+	go pool.get(context.Background())
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := pool.get(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error waiting for a connection. Expected %v got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Waiting for a connection outlived the context: %s", elapsed)
+	}
+}
+
+func TestPipelinedConnNoFreeIDs(t *testing.T) {
+	pool := newTCPPool(startSilentUpstream(t), testLimits(1, time.Minute, 0))
+	defer pool.Close()
+
+	c, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatalf("Error opening connection: %s", err.Error())
+	}
+	c.lock.Lock()
+	for id := range 65536 {
+		c.pending[uint16(id)] = make(chan []byte, 1)
+	}
+	c.lock.Unlock()
+
+	if _, err := c.exchange(context.Background(), testQuery()); err != errConnBusy {
+		t.Errorf("Unexpected error exchanging message. Expected %v got %v", errConnBusy, err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicTransport sends queries to a DNS over Quic upstream server (RFC 9250). A single connection is
+// kept open to the server, with each query sent on its own stream.
+type quicTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+	config    *quic.Config
+	limits    upstreamLimits
+
+	lock   *sync.Mutex
+	conn   *quic.Conn
+	closed bool
+}
+
+func newQuicTransport(addr string, tlsConfig *tls.Config, limits upstreamLimits) *quicTransport {
+	return &quicTransport{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		config: &quic.Config{
+			MaxIdleTimeout:       limits.idleTimeout,
+			HandshakeIdleTimeout: limits.dialTimeout,
+		},
+		limits: limits,
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Exchange sends the given DNS message to the upstream server on a new stream and returns its reply.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+//
+// If the connection is closed before a reply is received the query is sent again on a new
+// connection, up to the configured number of reconnect attempts.
+func (t *quicTransport) Exchange(ctx context.Context, message []byte) ([]byte, error) {
+	if len(message) < 14 {
+		return nil, errMessageTooShort
+	}
+
+	// DoQ requires that the message ID is always 0
+	query := make([]byte, len(message))
+	copy(query, message)
+	query[2], query[3] = 0, 0
+
+	var lastErr error
+	for attempt := 0; attempt <= t.limits.reconnects; attempt++ {
+		conn, err := t.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := t.exchange(ctx, conn, query)
+		if err == nil {
+			// Restore the message ID the client used
+			copy(reply[2:4], message[2:4])
+			return reply, nil
+		}
+		lastErr = err
+		if isTimeout(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		if conn.Context().Err() == nil {
+			// The stream failed but the connection is still open
+			continue
+		}
+		t.drop(conn)
+		log.PDebug("Upstream connection failed, reconnecting", map[string]any{
+			"upstream": t.addr,
+			"attempt":  attempt + 1,
+			"error":    err.Error(),
+		})
+	}
+
+	return nil, lastErr
+}
+
+func (t *quicTransport) exchange(ctx context.Context, conn *quic.Conn, query []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CancelRead(0)
+
+	stream.SetWriteDeadline(time.Now().Add(t.limits.writeTimeout))
+	deadline := time.Now().Add(t.limits.readTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	stream.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(0)
+	})
+	defer stop()
+
+	if _, err := stream.Write(query); err != nil {
+		return nil, err
+	}
+	// The client must indicate that it won't send any more data on the stream
+	stream.Close()
+
+	rawSize := make([]byte, 2)
+	if _, err := io.ReadFull(stream, rawSize); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	reply := make([]byte, 2+int(binary.BigEndian.Uint16(rawSize)))
+	copy(reply, rawSize)
+	if _, err := io.ReadFull(stream, reply[2:]); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if len(reply) < 4 {
+		return nil, errMessageTooShort
+	}
+
+	return reply, nil
+}
+
+// get returns the open connection to the upstream server, connecting if needed
+func (t *quicTransport) get(ctx context.Context) (*quic.Conn, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return nil, errPoolClosed
+	}
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, nil
+	}
+
+	conn, err := quic.DialAddr(ctx, t.addr, t.tlsConfig, t.config)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	log.PDebug("Opened upstream connection", map[string]any{
+		"upstream":   t.addr,
+		"local_addr": conn.LocalAddr().String(),
+	})
+	return conn, nil
+}
+
+// drop closes the given connection if it is still the open connection to the upstream server
+func (t *quicTransport) drop(conn *quic.Conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conn == conn {
+		t.conn = nil
+	}
+	conn.CloseWithError(0, "")
+}
+
+func (t *quicTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	if t.conn != nil {
+		t.conn.CloseWithError(0, "")
+		t.conn = nil
+	}
+}
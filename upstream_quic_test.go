@@ -0,0 +1,106 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestQuicUpstream(t *testing.T) {
+	dir := t.TempDir()
+	certPath := path.Join(dir, "localhost.crt")
+	keyPath := path.Join(dir, "localhost.key")
+	generateTestCert(certPath, keyPath)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Error loading test certificate: %s", err.Error())
+	}
+
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+
+	conns := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					message, err := io.ReadAll(stream)
+					if err != nil || binary.BigEndian.Uint16(message[2:4]) != 0 {
+						stream.CancelWrite(0)
+						continue
+					}
+					message[4] |= 0x80
+					stream.Write(message)
+					stream.Close()
+				}
+			}()
+		}
+	}()
+
+	config, err := parseUpstreamConfig("quic://" + l.Addr().String() + " ca=" + certPath)
+	if err != nil {
+		t.Fatalf("Error parsing upstream config: %s", err.Error())
+	}
+	tlsConfig, err := newUpstreamTLSConfig(config, []string{"doq"})
+	if err != nil {
+		t.Fatalf("Error setting up TLS config: %s", err.Error())
+	}
+	transport := newQuicTransport(config.Addr, tlsConfig, testLimits(1, time.Minute, 1))
+	defer transport.Close()
+
+	for range 5 {
+		message := testQuery()
+		reply, err := transport.Exchange(context.Background(), message)
+		if err != nil {
+			t.Fatalf("Error exchanging message: %s", err.Error())
+		}
+		if !bytes.Equal(reply[:4], message[:4]) {
+			t.Errorf("Unexpected length or message ID in reply")
+		}
+		if !bytes.Equal(reply[5:], message[5:]) {
+			t.Errorf("Reply does not match query")
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Unexpected number of upstream connections. Expected 1 got %d", n)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type raceResult struct {
+	reply    []byte
+	upstream *upstream
+	err      error
+}
+
+// race sends the given DNS message to all of the given upstream servers and returns the first
+// reply that isn't SERVFAIL. Servers are started in order, each one after the configured race
+// delay or as soon as the previous server failed, whichever comes first. Once a reply is accepted
+// the queries still outstanding to the other servers are cancelled.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+func (g *upstreamGroup) race(ctx context.Context, racers []*upstream, message []byte) ([]byte, *upstream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(racers))
+	start := func(u *upstream) {
+		go func() {
+			reply, err := g.exchangeWith(ctx, u, message)
+			results <- raceResult{reply, u, err}
+		}()
+	}
+
+	start(racers[0])
+	started := 1
+	pending := 1
+
+	var delay <-chan time.Time
+	if started < len(racers) {
+		delay = time.After(serverConfig.UpstreamRaceDelay)
+	}
+	startNext := func() {
+		if started >= len(racers) {
+			delay = nil
+			return
+		}
+		start(racers[started])
+		started++
+		pending++
+		delay = nil
+		if started < len(racers) {
+			delay = time.After(serverConfig.UpstreamRaceDelay)
+		}
+	}
+
+	var lastErr error = errNoUpstreams
+	var servfail *raceResult
+	for pending > 0 || started < len(racers) {
+		if pending == 0 {
+			startNext()
+			continue
+		}
+
+		select {
+		case <-delay:
+			startNext()
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				lastErr = result.err
+				if ctx.Err() != nil {
+					return nil, nil, raceError(lastErr)
+				}
+				startNext()
+				continue
+			}
+			if isServfail(result.reply) {
+				lastErr = fmt.Errorf("upstream server %s replied with SERVFAIL", result.upstream.addr)
+				servfail = &result
+				startNext()
+				continue
+			}
+
+			log.PDebug("Upstream server won race", map[string]any{
+				"upstream": result.upstream.addr,
+				"racers":   started,
+			})
+			return result.reply, result.upstream, nil
+		}
+	}
+
+	// Every upstream server replied with SERVFAIL or failed, pass on the SERVFAIL
+	if servfail != nil {
+		return servfail.reply, servfail.upstream, nil
+	}
+	return nil, nil, raceError(lastErr)
+}
+
+func raceError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("query timed out after %s", serverConfig.UpstreamQueryTimeout)
+	}
+	return err
+}
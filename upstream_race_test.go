@@ -0,0 +1,67 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRace(t *testing.T) {
+	setTestConfig(t, func(config *tServerConfig) {
+		config.UpstreamRaceCount = 2
+	})
+
+	silentAddr := startSilentUpstream(t)
+	liveAddr := startEchoUpstream(t, nil)
+
+	group, err := newUpstreamGroup([]tUpstreamConfig{testUpstreamConfig(silentAddr), testUpstreamConfig(liveAddr)}, strategyPriority)
+	if err != nil {
+		t.Fatalf("Error setting up upstreams: %s", err.Error())
+	}
+	defer group.Close()
+
+	for _, delay := range []time.Duration{0, 100 * time.Millisecond} {
+		setTestConfig(t, func(config *tServerConfig) {
+			config.UpstreamRaceDelay = delay
+		})
+
+		start := time.Now()
+		_, u, err := group.Exchange(context.Background(), testQuery())
+		if err != nil {
+			t.Fatalf("Error exchanging message: %s", err.Error())
+		}
+		elapsed := time.Since(start)
+		if u.addr != liveAddr {
+			t.Errorf("Unexpected upstream won race: %s", u.addr)
+		}
+		if elapsed < delay {
+			t.Errorf("Second upstream started before race delay. Elapsed %s", elapsed)
+		}
+		if elapsed > delay+serverConfig.UpstreamReadTimeout/2 {
+			t.Errorf("Race took too long. Elapsed %s", elapsed)
+		}
+	}
+
+	// The losing upstream was cancelled, not failed
+	if group.upstreams[0].failures != 0 {
+		t.Errorf("Cancelled upstream was recorded as failing")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	mathrand "math/rand/v2"
+	"slices"
+)
+
+const (
+	strategyPriority       = "priority"
+	strategyRoundRobin     = "round_robin"
+	strategyWeightedRandom = "weighted_random"
+	strategyLowestLatency  = "lowest_latency"
+)
+
+var upstreamStrategies = []string{strategyPriority, strategyRoundRobin, strategyWeightedRandom, strategyLowestLatency}
+
+// latencyAlpha is the weight given to the newest sample in the moving average of upstream latency
+const latencyAlpha = 0.3
+
+// order returns the given upstream servers in the order they should be tried according to the
+// groups strategy. The first server is the one that should answer the query, the remainder are
+// used for failover.
+func (g *upstreamGroup) order(candidates []*upstream) []*upstream {
+	if len(candidates) <= 1 {
+		return candidates
+	}
+
+	switch g.strategy {
+	case strategyRoundRobin:
+		start := int((g.next.Add(1) - 1) % uint64(len(candidates)))
+		return append(slices.Clone(candidates[start:]), candidates[:start]...)
+	case strategyWeightedRandom:
+		return weightedShuffle(candidates)
+	case strategyLowestLatency:
+		ordered := slices.Clone(candidates)
+		slices.SortStableFunc(ordered, func(a, b *upstream) int {
+			la, lb := a.averageLatency(), b.averageLatency()
+			if la < lb {
+				return -1
+			} else if la > lb {
+				return 1
+			}
+			return 0
+		})
+		return ordered
+	default:
+		return candidates
+	}
+}
+
+// weightedShuffle returns the upstream servers in a random order, where the chance of each server
+// being placed before the others is proportional to its weight.
+func weightedShuffle(candidates []*upstream) []*upstream {
+	remaining := slices.Clone(candidates)
+	ordered := make([]*upstream, 0, len(candidates))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, u := range remaining {
+			total += u.weight
+		}
+
+		pick := mathrand.IntN(total)
+		for i, u := range remaining {
+			pick -= u.weight
+			if pick < 0 {
+				ordered = append(ordered, u)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
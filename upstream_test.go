@@ -0,0 +1,273 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// unusedAddr returns a local address that nothing is listening on
+func unusedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error finding unused address: %s", err.Error())
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func testUpstreamConfig(addr string) tUpstreamConfig {
+	config, err := parseUpstreamConfig(addr)
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+func testQuery() []byte {
+	message := make([]byte, 2+len(dnsMessage))
+	binary.BigEndian.PutUint16(message, uint16(len(dnsMessage)))
+	copy(message[2:], dnsMessage)
+	return message
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	deadAddr := unusedAddr(t)
+	liveAddr := startEchoUpstream(t, nil)
+
+	group, err := newUpstreamGroup([]tUpstreamConfig{testUpstreamConfig(deadAddr), testUpstreamConfig(liveAddr)}, strategyPriority)
+	if err != nil {
+		t.Fatalf("Error setting up upstreams: %s", err.Error())
+	}
+	defer group.Close()
+
+	for range serverConfig.UpstreamMaxFails {
+		if _, _, err := group.Exchange(context.Background(), testQuery()); err != nil {
+			t.Fatalf("Error exchanging message: %s", err.Error())
+		}
+	}
+
+	if group.upstreams[0].isHealthy() {
+		t.Errorf("Dead upstream was not marked as unhealthy")
+	}
+	if !group.upstreams[1].isHealthy() {
+		t.Errorf("Live upstream was marked as unhealthy")
+	}
+
+	if healthy := group.healthyUpstreams(); len(healthy) != 1 || healthy[0].addr != liveAddr {
+		t.Errorf("Unexpected healthy upstreams")
+	}
+}
+
+func TestUpstreamAllUnhealthy(t *testing.T) {
+	group, err := newUpstreamGroup([]tUpstreamConfig{testUpstreamConfig(unusedAddr(t)), testUpstreamConfig(unusedAddr(t))}, strategyPriority)
+	if err != nil {
+		t.Fatalf("Error setting up upstreams: %s", err.Error())
+	}
+	defer group.Close()
+
+	for range serverConfig.UpstreamMaxFails {
+		if _, _, err := group.Exchange(context.Background(), testQuery()); err == nil {
+			t.Fatalf("No error seen when all upstreams are unavailable")
+		}
+	}
+
+	if len(group.healthyUpstreams()) != 0 {
+		t.Errorf("Unexpected healthy upstreams")
+	}
+
+	// Unhealthy upstreams are still tried when there are no healthy ones
+	if _, _, err := group.Exchange(context.Background(), testQuery()); err == nil {
+		t.Fatalf("No error seen when all upstreams are unavailable")
+	}
+}
+
+func TestUpstreamPassiveRecovery(t *testing.T) {
+	setTestConfig(t, func(config *tServerConfig) {
+		config.UpstreamHealthCheckInterval = 0
+	})
+
+	deadAddr := unusedAddr(t)
+	liveAddr := startEchoUpstream(t, nil)
+
+	group, err := newUpstreamGroup([]tUpstreamConfig{testUpstreamConfig(deadAddr), testUpstreamConfig(liveAddr)}, strategyPriority)
+	if err != nil {
+		t.Fatalf("Error setting up upstreams: %s", err.Error())
+	}
+	defer group.Close()
+	dead := group.upstreams[0]
+
+	for range serverConfig.UpstreamMaxFails {
+		if _, _, err := group.Exchange(context.Background(), testQuery()); err != nil {
+			t.Fatalf("Error exchanging message: %s", err.Error())
+		}
+	}
+	if dead.isHealthy() {
+		t.Fatalf("Dead upstream was not marked as unhealthy")
+	}
+	if healthy := group.healthyUpstreams(); len(healthy) != 1 {
+		t.Errorf("Unhealthy upstream was retried before its retry delay passed")
+	}
+
+	expireRetry := func() {
+		dead.lock.Lock()
+		dead.retryAt = time.Now()
+		dead.lock.Unlock()
+	}
+
+	// A failed retry doubles the delay before the next one
+	expireRetry()
+	if _, u, err := group.Exchange(context.Background(), testQuery()); err != nil || u.addr != liveAddr {
+		t.Fatalf("Unexpected result exchanging message: %v", err)
+	}
+	dead.lock.Lock()
+	retryDelay := dead.retryDelay
+	dead.lock.Unlock()
+	if retryDelay != 2*upstreamRetryMin {
+		t.Errorf("Unexpected retry delay. Expected %s got %s", 2*upstreamRetryMin, retryDelay)
+	}
+
+	l, err := net.Listen("tcp", deadAddr)
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	defer l.Close()
+	go serveEcho(l, nil)
+
+	expireRetry()
+	_, u, err := group.Exchange(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+	if u.addr != deadAddr || !dead.isHealthy() {
+		t.Errorf("Recovered upstream was not re-admitted")
+	}
+}
+
+// startSilentUpstream starts a DNS-over-TCP server that accepts connections but never replies
+func startSilentUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestUpstreamTimeoutRetry(t *testing.T) {
+	setTestConfig(t, func(config *tServerConfig) {
+		config.UpstreamReadTimeout = 100 * time.Millisecond
+		config.UpstreamQueryTimeout = 250 * time.Millisecond
+	})
+
+	silentAddr := startSilentUpstream(t)
+	liveAddr := startEchoUpstream(t, nil)
+
+	group, err := newUpstreamGroup([]tUpstreamConfig{testUpstreamConfig(silentAddr), testUpstreamConfig(liveAddr)}, strategyPriority)
+	if err != nil {
+		t.Fatalf("Error setting up upstreams: %s", err.Error())
+	}
+	defer group.Close()
+
+	_, u, err := group.Exchange(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+	if u.addr != liveAddr {
+		t.Errorf("Query was not retried on the next upstream")
+	}
+
+	// The total query time is enforced across retries
+	silentGroup, err := newUpstreamGroup([]tUpstreamConfig{testUpstreamConfig(startSilentUpstream(t)), testUpstreamConfig(startSilentUpstream(t)), testUpstreamConfig(startSilentUpstream(t))}, strategyPriority)
+	if err != nil {
+		t.Fatalf("Error setting up upstreams: %s", err.Error())
+	}
+	defer silentGroup.Close()
+
+	start := time.Now()
+	if _, _, err := silentGroup.Exchange(context.Background(), testQuery()); err == nil {
+		t.Fatalf("No error seen when all upstreams time out")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+serverConfig.UpstreamQueryTimeout {
+		t.Errorf("Query took %s, longer than the query timeout", elapsed)
+	}
+}
+
+func TestUpstreamStrategyOrder(t *testing.T) {
+	a := &upstream{addr: "a", weight: 1, lock: &sync.Mutex{}, latency: 30 * time.Millisecond}
+	b := &upstream{addr: "b", weight: 1, lock: &sync.Mutex{}, latency: 10 * time.Millisecond}
+	c := &upstream{addr: "c", weight: 1, lock: &sync.Mutex{}, latency: 20 * time.Millisecond}
+	candidates := []*upstream{a, b, c}
+
+	addrs := func(ordered []*upstream) string {
+		s := ""
+		for _, u := range ordered {
+			s += u.addr
+		}
+		return s
+	}
+
+	group := &upstreamGroup{strategy: strategyPriority, next: &atomic.Uint64{}}
+	if order := addrs(group.order(candidates)); order != "abc" {
+		t.Errorf("Unexpected priority order %s", order)
+	}
+
+	group.strategy = strategyRoundRobin
+	for _, expected := range []string{"abc", "bca", "cab", "abc"} {
+		if order := addrs(group.order(candidates)); order != expected {
+			t.Errorf("Unexpected round robin order. Expected %s got %s", expected, order)
+		}
+	}
+
+	group.strategy = strategyLowestLatency
+	if order := addrs(group.order(candidates)); order != "bca" {
+		t.Errorf("Unexpected lowest latency order %s", order)
+	}
+
+	group.strategy = strategyWeightedRandom
+	a.weight = 1000
+	first := map[string]int{}
+	for range 100 {
+		ordered := group.order(candidates)
+		if len(ordered) != 3 {
+			t.Fatalf("Unexpected number of upstreams %d", len(ordered))
+		}
+		first[ordered[0].addr]++
+	}
+	if first["a"] < 80 {
+		t.Errorf("Heavily weighted upstream was not preferred: %v", first)
+	}
+}
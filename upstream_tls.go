@@ -0,0 +1,107 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+)
+
+// newTLSPool returns a connection pool where each connection is a DNS over TLS session (RFC 7858)
+// with the upstream server. TLS sessions are resumed when reconnecting.
+func newTLSPool(addr string, tlsConfig *tls.Config, limits upstreamLimits) *tcpPool {
+	pool := newTCPPool(addr, limits)
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: limits.dialTimeout},
+		Config:    tlsConfig,
+	}
+	pool.dial = func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	return pool
+}
+
+// newUpstreamTLSConfig returns the TLS configuration for connecting to the given upstream server.
+// The servers certificate is always verified against either the system root store or the CA
+// bundle from the ca option. If any pin options are set then at least one certificate in the
+// chain must also have a public key matching one of the pins.
+func newUpstreamTLSConfig(config tUpstreamConfig, nextProtos []string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		NextProtos:         nextProtos,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if config.SNI != "" {
+		tlsConfig.ServerName = config.SNI
+	}
+
+	if config.CAPath != "" {
+		pem, err := os.ReadFile(config.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CAPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.Pins) > 0 {
+		pins := make([][]byte, len(config.Pins))
+		for i, pin := range config.Pins {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %s: must be a base64 encoded SHA-256 hash", pin)
+			}
+			pins[i] = hash
+		}
+
+		// Pins are checked against the verified chains rather than the certificates the server sent,
+		// as a server can send any certificate alongside the ones that were verified
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if bytes.Equal(hash[:], pin) {
+							return nil
+						}
+					}
+				}
+			}
+			return fmt.Errorf("no certificate in the verified chain for %s matches a pinned public key", config.Name)
+		}
+	}
+
+	return tlsConfig, nil
+}
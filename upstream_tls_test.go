@@ -0,0 +1,154 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTLSEchoUpstream starts a DNS-over-TLS echo server. Returns the servers address, the path to
+// its certificate, and the base64 SHA-256 hash of its public key.
+func startTLSEchoUpstream(t *testing.T, conns *atomic.Int32) (string, string, string) {
+	dir := t.TempDir()
+	certPath := path.Join(dir, "localhost.crt")
+	keyPath := path.Join(dir, "localhost.key")
+	generateTestCert(certPath, keyPath)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Error loading test certificate: %s", err.Error())
+	}
+	pin := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go serveEcho(l, conns)
+	return l.Addr().String(), certPath, base64.StdEncoding.EncodeToString(pin[:])
+}
+
+func TestTLSUpstream(t *testing.T) {
+	conns := &atomic.Int32{}
+	addr, certPath, pin := startTLSEchoUpstream(t, conns)
+
+	check := func(entry string, expectSuccess bool) {
+		config, err := parseUpstreamConfig(entry)
+		if err != nil {
+			t.Fatalf("Error parsing upstream config: %s", err.Error())
+		}
+		tlsConfig, err := newUpstreamTLSConfig(config, nil)
+		if err != nil {
+			t.Fatalf("Error setting up TLS config: %s", err.Error())
+		}
+		pool := newTLSPool(config.Addr, tlsConfig, testLimits(1, time.Minute, 0))
+		defer pool.Close()
+
+		_, err = pool.Exchange(context.Background(), testQuery())
+		if expectSuccess && err != nil {
+			t.Errorf("Error exchanging message with %s: %s", entry, err.Error())
+		} else if !expectSuccess && err == nil {
+			t.Errorf("No error seen exchanging message with %s", entry)
+		}
+	}
+
+	check("tls://"+addr, false)
+	check("tls://"+addr+" ca="+certPath, true)
+	check("tls://"+addr+" ca="+certPath+" sni=example.com", false)
+	check("tls://"+addr+" ca="+certPath+" pin="+pin, true)
+	check("tls://"+addr+" ca="+certPath+" pin="+base64.StdEncoding.EncodeToString(make([]byte, 32)), false)
+	check("tls://"+addr+" ca="+certPath+" pin="+base64.StdEncoding.EncodeToString(make([]byte, 32))+" pin="+pin, true)
+}
+
+func TestTLSUpstreamReuse(t *testing.T) {
+	conns := &atomic.Int32{}
+	addr, certPath, _ := startTLSEchoUpstream(t, conns)
+
+	config, _ := parseUpstreamConfig("tls://" + addr + " ca=" + certPath)
+	tlsConfig, err := newUpstreamTLSConfig(config, nil)
+	if err != nil {
+		t.Fatalf("Error setting up TLS config: %s", err.Error())
+	}
+	pool := newTLSPool(config.Addr, tlsConfig, testLimits(1, time.Minute, 0))
+	defer pool.Close()
+
+	for range 10 {
+		if _, err := pool.Exchange(context.Background(), testQuery()); err != nil {
+			t.Fatalf("Error exchanging message: %s", err.Error())
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Unexpected number of upstream connections. Expected 1 got %d", n)
+	}
+}
+
+func TestTLSUpstreamPinOutsideChain(t *testing.T) {
+	dir := t.TempDir()
+	certPath := path.Join(dir, "localhost.crt")
+	keyPath := path.Join(dir, "localhost.key")
+	generateTestCert(certPath, keyPath)
+	pinnedCertPath := path.Join(dir, "pinned.crt")
+	pinnedKeyPath := path.Join(dir, "pinned.key")
+	generateTestCert(pinnedCertPath, pinnedKeyPath)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Error loading test certificate: %s", err.Error())
+	}
+	pinnedCert, err := tls.LoadX509KeyPair(pinnedCertPath, pinnedKeyPath)
+	if err != nil {
+		t.Fatalf("Error loading test certificate: %s", err.Error())
+	}
+	pin := sha256.Sum256(pinnedCert.Leaf.RawSubjectPublicKeyInfo)
+
+	// The server sends the pinned certificate after its own, but it is not part of the verified chain
+	cert.Certificate = append(cert.Certificate, pinnedCert.Certificate[0])
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	defer l.Close()
+	go serveEcho(l, &atomic.Int32{})
+
+	config, err := parseUpstreamConfig("tls://" + l.Addr().String() + " ca=" + certPath + " pin=" + base64.StdEncoding.EncodeToString(pin[:]))
+	if err != nil {
+		t.Fatalf("Error parsing upstream config: %s", err.Error())
+	}
+	tlsConfig, err := newUpstreamTLSConfig(config, nil)
+	if err != nil {
+		t.Fatalf("Error setting up TLS config: %s", err.Error())
+	}
+	pool := newTLSPool(config.Addr, tlsConfig, testLimits(1, time.Minute, 0))
+	defer pool.Close()
+
+	if _, err := pool.Exchange(context.Background(), testQuery()); err == nil {
+		t.Errorf("No error seen exchanging message with a pin outside of the verified chain")
+	}
+}
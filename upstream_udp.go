@@ -0,0 +1,197 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	mathrand "math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// udpTransport sends queries to an upstream server over UDP, retrying the query over TCP if the
+// reply was truncated.
+type udpTransport struct {
+	addr       string
+	bufferSize uint16
+	limits     upstreamLimits
+	fallback   *tcpPool
+}
+
+func newUDPTransport(addr string, bufferSize uint16, limits upstreamLimits) *udpTransport {
+	return &udpTransport{
+		addr:       addr,
+		bufferSize: bufferSize,
+		limits:     limits,
+		fallback:   newTCPPool(addr, limits),
+	}
+}
+
+// Exchange sends the given DNS message to the upstream server over UDP and returns its reply.
+// The message MUST include a 2-byte big-endian length at the start, as will the reply.
+//
+// Each query is sent from a new socket, so that it uses a random source port, and with a random
+// message ID. Any datagram that does not match the query is ignored.
+func (t *udpTransport) Exchange(ctx context.Context, message []byte) ([]byte, error) {
+	if len(message) < 14 {
+		return nil, errMessageTooShort
+	}
+
+	query := &dnsmessage.Message{}
+	if err := query.Unpack(message[2:]); err != nil {
+		return nil, err
+	}
+	query.ID = uint16(mathrand.UintN(65536))
+	addedOPT := setEDNSBufferSize(query, t.bufferSize)
+	queryData, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: t.limits.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(t.limits.readTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write(queryData); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, max(int(t.bufferSize), 512))
+	var reply *dnsmessage.Message
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		p := dnsmessage.Parser{}
+		header, err := p.Start(buf[:n])
+		if err != nil || !header.Response || header.ID != query.ID {
+			log.PDebug("Discarding unexpected reply from upstream", map[string]any{
+				"upstream": t.addr,
+			})
+			continue
+		}
+
+		if header.Truncated {
+			log.PDebug("Upstream reply truncated, retrying over TCP", map[string]any{
+				"upstream": t.addr,
+			})
+			return t.fallback.Exchange(ctx, message)
+		}
+
+		reply = &dnsmessage.Message{}
+		if err := reply.Unpack(buf[:n]); err != nil || !isReplyFor(query, reply) {
+			log.PDebug("Discarding unexpected reply from upstream", map[string]any{
+				"upstream": t.addr,
+			})
+			continue
+		}
+		break
+	}
+
+	// Restore the message ID the client used, and don't give the client an OPT record if it didn't
+	// ask for one
+	reply.ID = binary.BigEndian.Uint16(message[2:4])
+	if addedOPT {
+		additionals := reply.Additionals[:0]
+		for _, rr := range reply.Additionals {
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				additionals = append(additionals, rr)
+			}
+		}
+		reply.Additionals = additionals
+	}
+
+	replyData, err := reply.AppendPack(make([]byte, 2, 2+len(buf)))
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(replyData, uint16(len(replyData)-2))
+	return replyData, nil
+}
+
+func (t *udpTransport) Close() {
+	t.fallback.Close()
+}
+
+// setEDNSBufferSize sets the UDP payload size advertised in the OPT record of the message, adding
+// an OPT record if the message doesn't have one. Returns true if an OPT record was added.
+func setEDNSBufferSize(m *dnsmessage.Message, size uint16) bool {
+	for i, rr := range m.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			m.Additionals[i].Header.Class = dnsmessage.Class(size)
+			return false
+		}
+	}
+
+	opt := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("."),
+			Type:  dnsmessage.TypeOPT,
+			Class: dnsmessage.Class(size),
+		},
+		Body: &dnsmessage.OPTResource{},
+	}
+	m.Additionals = append(m.Additionals, opt)
+	return true
+}
+
+// isReplyFor checks that the reply has the same message ID and question section as the query. Error
+// replies are allowed to omit the question section.
+func isReplyFor(query, reply *dnsmessage.Message) bool {
+	if !reply.Response || reply.ID != query.ID {
+		return false
+	}
+	if len(reply.Questions) == 0 && reply.RCode != dnsmessage.RCodeSuccess {
+		return true
+	}
+	if len(reply.Questions) != len(query.Questions) {
+		return false
+	}
+
+	for i, q := range query.Questions {
+		r := reply.Questions[i]
+		if r.Type != q.Type || r.Class != q.Class || !strings.EqualFold(r.Name.String(), q.Name.String()) {
+			return false
+		}
+	}
+
+	return true
+}
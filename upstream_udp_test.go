@@ -0,0 +1,157 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startUDPUpstream starts a DNS-over-UDP server on the same port as a DNS-over-TCP echo server.
+// Every query is first answered with a datagram that has the wrong message ID, then with an empty
+// reply. Queries for truncated.example. get a truncated reply. The OPT record of the last query is
+// written to opt.
+func startUDPUpstream(t *testing.T, tcpConns *atomic.Int32, opt *atomic.Pointer[dnsmessage.Resource]) string {
+	addr := startEchoUpstream(t, tcpConns)
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("Error starting test upstream: %s", err.Error())
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			query := &dnsmessage.Message{}
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			for _, rr := range query.Additionals {
+				if rr.Header.Type == dnsmessage.TypeOPT {
+					opt.Store(&rr)
+				}
+			}
+
+			reply := *query
+			reply.Response = true
+			reply.ID = query.ID + 1
+			replyData, _ := reply.Pack()
+			pc.WriteTo(replyData, from)
+
+			reply.ID = query.ID
+			reply.Truncated = query.Questions[0].Name.String() == "truncated.example."
+			replyData, _ = reply.Pack()
+			pc.WriteTo(replyData, from)
+		}
+	}()
+
+	return addr
+}
+
+func buildTestQuery(name string, withOPT bool) []byte {
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	if withOPT {
+		builder.StartAdditionals()
+		rh := dnsmessage.ResourceHeader{}
+		rh.SetEDNS0(4096, dnsmessage.RCodeSuccess, false)
+		builder.OPTResource(rh, dnsmessage.OPTResource{})
+	}
+	message, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+	binary.BigEndian.PutUint16(message, uint16(len(message)-2))
+	return message
+}
+
+func TestUDPTransport(t *testing.T) {
+	tcpConns := &atomic.Int32{}
+	opt := &atomic.Pointer[dnsmessage.Resource]{}
+	addr := startUDPUpstream(t, tcpConns, opt)
+
+	transport := newUDPTransport(addr, 1232, testLimits(1, time.Minute, 0))
+	defer transport.Close()
+
+	reply, err := transport.Exchange(context.Background(), buildTestQuery("example.com.", false))
+	if err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+	m := &dnsmessage.Message{}
+	if err := m.Unpack(reply[2:]); err != nil {
+		t.Fatalf("Error parsing reply: %s", err.Error())
+	}
+	if m.ID != 1234 {
+		t.Errorf("Unexpected message ID in reply %d", m.ID)
+	}
+	if len(m.Additionals) != 0 {
+		t.Errorf("Unexpected OPT record in reply")
+	}
+	if sent := opt.Load(); sent == nil || sent.Header.Class != 1232 {
+		t.Errorf("Query was not sent with the configured EDNS buffer size")
+	}
+
+	if _, err := transport.Exchange(context.Background(), buildTestQuery("example.com.", true)); err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+	if sent := opt.Load(); sent == nil || sent.Header.Class != 1232 {
+		t.Errorf("Query was not sent with the configured EDNS buffer size")
+	}
+
+	if tcpConns.Load() != 0 {
+		t.Errorf("Unexpected TCP connection to upstream")
+	}
+}
+
+func TestUDPTransportTruncated(t *testing.T) {
+	tcpConns := &atomic.Int32{}
+	opt := &atomic.Pointer[dnsmessage.Resource]{}
+	addr := startUDPUpstream(t, tcpConns, opt)
+
+	transport := newUDPTransport(addr, 1232, testLimits(1, time.Minute, 0))
+	defer transport.Close()
+
+	reply, err := transport.Exchange(context.Background(), buildTestQuery("truncated.example.", false))
+	if err != nil {
+		t.Fatalf("Error exchanging message: %s", err.Error())
+	}
+	if id := binary.BigEndian.Uint16(reply[2:4]); id != 1234 {
+		t.Errorf("Unexpected message ID in reply %d", id)
+	}
+	if tcpConns.Load() != 1 {
+		t.Errorf("Truncated reply was not retried over TCP")
+	}
+}
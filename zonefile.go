@@ -0,0 +1,571 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// zoneToken is a single field from a zone file
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneEntry is a single logical line from a zone file, which may span several physical lines when
+// parentheses are used
+type zoneEntry struct {
+	tokens []zoneToken
+	// blankOwner is true if the line starts with whitespace, meaning the owner name is the same as
+	// the previous record
+	blankOwner bool
+	line       int
+}
+
+// zoneParser reads RFC 1035 master files
+type zoneParser struct {
+	origin     string
+	defaultTTL uint32
+	hasTTL     bool
+	lastName   string
+	lastTTL    uint32
+	records    []dnsmessage.Resource
+	// depth is the number of $INCLUDE directives being processed, to stop include loops
+	depth int
+}
+
+// parseZoneFile returns every record in the zone file at the given path. Relative names in the file
+// are relative to the given origin, which must be fully qualified, unless changed by an $ORIGIN
+// directive. The $TTL and $INCLUDE directives are also supported.
+func parseZoneFile(path, origin string) ([]dnsmessage.Resource, error) {
+	p := &zoneParser{origin: strings.ToLower(origin)}
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// parseZoneRecord parses a single record in zone file format, such as "www 300 IN A 192.0.2.1".
+// Relative names are relative to the given origin, and the given TTL is used if the record doesn't
+// have one.
+func parseZoneRecord(line, origin string, ttl uint32) (dnsmessage.Resource, error) {
+	entries, err := tokenizeZone(line)
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	if len(entries) != 1 || entries[0].blankOwner || strings.HasPrefix(entries[0].tokens[0].text, "$") {
+		return dnsmessage.Resource{}, fmt.Errorf("expected a single record")
+	}
+	p := &zoneParser{origin: strings.ToLower(origin), defaultTTL: ttl, hasTTL: true}
+	if err := p.parseEntry("", entries[0]); err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	return p.records[0], nil
+}
+
+func (p *zoneParser) parseFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entries, err := tokenizeZone(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	for _, entry := range entries {
+		if err := p.parseEntry(path, entry); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, entry.line, err.Error())
+		}
+	}
+	return nil
+}
+
+// tokenizeZone splits the zone file into entries of tokens, removing comments and joining lines
+// that are within parentheses
+func tokenizeZone(data string) ([]zoneEntry, error) {
+	entries := []zoneEntry{}
+	line := 1
+	current := zoneEntry{line: line}
+	parens := 0
+	atLineStart := true
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+			if parens == 0 {
+				if len(current.tokens) > 0 {
+					entries = append(entries, current)
+				}
+				current = zoneEntry{line: line}
+				atLineStart = true
+			}
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			if atLineStart && parens == 0 && len(current.tokens) == 0 {
+				current.blankOwner = true
+			}
+			i++
+		case c == ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '(':
+			parens++
+			i++
+		case c == ')':
+			parens--
+			if parens < 0 {
+				return nil, fmt.Errorf("line %d: unexpected )", line)
+			}
+			i++
+		case c == '"':
+			text := strings.Builder{}
+			i++
+			for {
+				if i >= len(data) {
+					return nil, fmt.Errorf("line %d: unterminated string", line)
+				}
+				if data[i] == '"' {
+					i++
+					break
+				}
+				if data[i] == '\n' {
+					line++
+				}
+				if data[i] == '\\' && i+1 < len(data) {
+					if n, ok := decimalEscape(data[i+1:]); ok {
+						text.WriteByte(n)
+						i += 4
+						continue
+					}
+					i++
+				}
+				text.WriteByte(data[i])
+				i++
+			}
+			current.tokens = append(current.tokens, zoneToken{text: text.String(), quoted: true})
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n;()\"", rune(data[i])) {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				i++
+			}
+			current.tokens = append(current.tokens, zoneToken{text: data[start:i]})
+		}
+		atLineStart = false
+	}
+
+	if parens != 0 {
+		return nil, fmt.Errorf("line %d: missing )", line)
+	}
+	if len(current.tokens) > 0 {
+		entries = append(entries, current)
+	}
+	return entries, nil
+}
+
+// decimalEscape parses the \DDD escape at the start of the given string, without the backslash
+func decimalEscape(s string) (byte, bool) {
+	if len(s) < 3 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[:3], 10, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(n), true
+}
+
+// unescapeZoneText replaces the \X and \DDD escapes in an unquoted token
+func unescapeZoneText(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	text := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			if n, ok := decimalEscape(s[i+1:]); ok {
+				text.WriteByte(n)
+				i += 3
+				continue
+			}
+			i++
+		}
+		text.WriteByte(s[i])
+	}
+	return text.String()
+}
+
+func (p *zoneParser) parseEntry(path string, entry zoneEntry) error {
+	tokens := entry.tokens
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$ORIGIN requires a single name")
+		}
+		p.origin = p.absoluteName(tokens[1].text)
+		return nil
+	case "$TTL":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$TTL requires a single value")
+		}
+		ttl, ok := parseZoneTTL(tokens[1].text)
+		if !ok {
+			return fmt.Errorf("invalid $TTL value %s", tokens[1].text)
+		}
+		p.defaultTTL = ttl
+		p.hasTTL = true
+		return nil
+	case "$INCLUDE":
+		if len(tokens) < 2 || len(tokens) > 3 {
+			return fmt.Errorf("$INCLUDE requires a file name and optional origin")
+		}
+		if p.depth >= 8 {
+			return fmt.Errorf("too many nested $INCLUDE directives")
+		}
+		includePath := tokens[1].text
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+		included := &zoneParser{
+			origin:     p.origin,
+			defaultTTL: p.defaultTTL,
+			hasTTL:     p.hasTTL,
+			lastName:   p.lastName,
+			lastTTL:    p.lastTTL,
+			depth:      p.depth + 1,
+		}
+		if len(tokens) == 3 {
+			included.origin = p.absoluteName(tokens[2].text)
+		}
+		if err := included.parseFile(includePath); err != nil {
+			return err
+		}
+		p.records = append(p.records, included.records...)
+		return nil
+	}
+
+	name := p.lastName
+	if !entry.blankOwner {
+		name = p.absoluteName(tokens[0].text)
+		tokens = tokens[1:]
+	}
+	if name == "" {
+		return fmt.Errorf("record has no owner name")
+	}
+	p.lastName = name
+
+	// The TTL and class can be in either order, and are both optional
+	ttl := p.defaultTTL
+	explicitTTL := false
+	for range 2 {
+		if len(tokens) == 0 {
+			break
+		}
+		if strings.EqualFold(tokens[0].text, "IN") {
+			tokens = tokens[1:]
+		} else if v, ok := parseZoneTTL(tokens[0].text); ok {
+			ttl = v
+			explicitTTL = true
+			tokens = tokens[1:]
+		}
+	}
+	if !explicitTTL && !p.hasTTL {
+		ttl = p.lastTTL
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("record has no type")
+	}
+
+	rrType, ok := parseZoneType(tokens[0].text)
+	if !ok {
+		return fmt.Errorf("unsupported record type %s", tokens[0].text)
+	}
+	body, err := p.parseRData(rrType, tokens[1:])
+	if err != nil {
+		return fmt.Errorf("invalid %s record: %s", tokens[0].text, err.Error())
+	}
+	if soa, isSOA := body.(*dnsmessage.SOAResource); isSOA && !explicitTTL && !p.hasTTL && p.lastTTL == 0 {
+		// Without any TTL, use the SOA minimum (RFC 2308 section 4)
+		ttl = soa.MinTTL
+	}
+	p.lastTTL = ttl
+
+	rrName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return err
+	}
+	p.records = append(p.records, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  rrName,
+			Type:  rrType,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: body,
+	})
+	return nil
+}
+
+// absoluteName returns the given name from the zone file as a lowercase fully qualified name
+func (p *zoneParser) absoluteName(name string) string {
+	name = strings.ToLower(name)
+	if name == "@" {
+		return p.origin
+	}
+	if strings.HasSuffix(name, ".") && !strings.HasSuffix(name, "\\.") {
+		return name
+	}
+	if p.origin == "." {
+		return name + "."
+	}
+	return name + "." + p.origin
+}
+
+func (p *zoneParser) parseName(name string) (dnsmessage.Name, error) {
+	return dnsmessage.NewName(p.absoluteName(name))
+}
+
+// zoneTypes are the record types that can be read from zone files, besides those using the generic
+// TYPEnnn syntax (RFC 3597)
+var zoneTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+func parseZoneType(s string) (dnsmessage.Type, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := zoneTypes[s]; ok {
+		return t, true
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		v, err := strconv.ParseUint(n, 10, 16)
+		return dnsmessage.Type(v), err == nil
+	}
+	return 0, false
+}
+
+// parseZoneTTL parses a TTL, which is either a number of seconds or a BIND style duration such as
+// 1h30m
+func parseZoneTTL(s string) (uint32, bool) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), true
+	}
+
+	var total, current uint64
+	hasDigits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			current = current*10 + uint64(c-'0')
+			hasDigits = true
+			continue
+		}
+		if !hasDigits {
+			return 0, false
+		}
+		switch c {
+		case 's':
+		case 'm':
+			current *= 60
+		case 'h':
+			current *= 3600
+		case 'd':
+			current *= 86400
+		case 'w':
+			current *= 604800
+		default:
+			return 0, false
+		}
+		total += current
+		current = 0
+		hasDigits = false
+	}
+	if hasDigits || total > 0xffffffff {
+		return 0, false
+	}
+	return uint32(total), true
+}
+
+func (p *zoneParser) parseRData(rrType dnsmessage.Type, tokens []zoneToken) (dnsmessage.ResourceBody, error) {
+	expect := func(n int) error {
+		if len(tokens) != n {
+			return fmt.Errorf("expected %d fields, got %d", n, len(tokens))
+		}
+		return nil
+	}
+	uint16Field := func(s string) (uint16, error) {
+		v, err := strconv.ParseUint(s, 10, 16)
+		return uint16(v), err
+	}
+
+	// Generic record data (RFC 3597)
+	if len(tokens) >= 2 && tokens[0].text == "\\#" {
+		length, err := strconv.Atoi(tokens[1].text)
+		if err != nil {
+			return nil, err
+		}
+		hexData := ""
+		for _, token := range tokens[2:] {
+			hexData += token.text
+		}
+		data, err := hex.DecodeString(hexData)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != length {
+			return nil, fmt.Errorf("data length does not match")
+		}
+		return &dnsmessage.UnknownResource{Type: rrType, Data: data}, nil
+	}
+
+	switch rrType {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		if rrType == dnsmessage.TypeA && addr.Is4() {
+			return &dnsmessage.AResource{A: addr.As4()}, nil
+		}
+		if rrType == dnsmessage.TypeAAAA && addr.Is6() {
+			return &dnsmessage.AAAAResource{AAAA: addr.As16()}, nil
+		}
+		return nil, fmt.Errorf("wrong address family")
+	case dnsmessage.TypeCNAME, dnsmessage.TypeNS, dnsmessage.TypePTR:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		name, err := p.parseName(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		switch rrType {
+		case dnsmessage.TypeCNAME:
+			return &dnsmessage.CNAMEResource{CNAME: name}, nil
+		case dnsmessage.TypeNS:
+			return &dnsmessage.NSResource{NS: name}, nil
+		default:
+			return &dnsmessage.PTRResource{PTR: name}, nil
+		}
+	case dnsmessage.TypeMX:
+		if err := expect(2); err != nil {
+			return nil, err
+		}
+		pref, err := uint16Field(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		name, err := p.parseName(tokens[1].text)
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.MXResource{Pref: pref, MX: name}, nil
+	case dnsmessage.TypeSRV:
+		if err := expect(4); err != nil {
+			return nil, err
+		}
+		values := make([]uint16, 3)
+		for i := range values {
+			v, err := uint16Field(tokens[i].text)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		target, err := p.parseName(tokens[3].text)
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.SRVResource{Priority: values[0], Weight: values[1], Port: values[2], Target: target}, nil
+	case dnsmessage.TypeTXT:
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("expected at least 1 field")
+		}
+		txt := make([]string, len(tokens))
+		for i, token := range tokens {
+			text := token.text
+			if !token.quoted {
+				text = unescapeZoneText(text)
+			}
+			if len(text) > 255 {
+				return nil, fmt.Errorf("string longer than 255 characters")
+			}
+			txt[i] = text
+		}
+		return &dnsmessage.TXTResource{TXT: txt}, nil
+	case dnsmessage.TypeSOA:
+		if err := expect(7); err != nil {
+			return nil, err
+		}
+		ns, err := p.parseName(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		mbox, err := p.parseName(tokens[1].text)
+		if err != nil {
+			return nil, err
+		}
+		serial, err := strconv.ParseUint(tokens[2].text, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		times := make([]uint32, 4)
+		for i := range times {
+			v, ok := parseZoneTTL(tokens[3+i].text)
+			if !ok {
+				return nil, fmt.Errorf("invalid time value %s", tokens[3+i].text)
+			}
+			times[i] = v
+		}
+		return &dnsmessage.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  uint32(serial),
+			Refresh: times[0],
+			Retry:   times[1],
+			Expire:  times[2],
+			MinTTL:  times[3],
+		}, nil
+	}
+
+	return nil, fmt.Errorf("record data must use the generic \\# syntax")
+}
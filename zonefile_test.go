@@ -0,0 +1,109 @@
+/*
+DNSProxy
+Copyright (C) 2024 Ian Spence
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnsproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseZoneFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "extra.zone"), []byte("extra IN A 192.0.2.9\n"), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+	path := filepath.Join(dir, "example.zone")
+	zone := `$TTL 1h
+@	IN SOA ns1 hostmaster (
+		2024010101 ; serial
+		1d 2h 4w 300 )
+	IN NS ns1
+ns1	300 IN A 192.0.2.1
+WWW	IN 60 AAAA 2001:db8::1
+alias	CNAME www
+	MX 10 mail.example.net.
+txt	TXT "hello world" "semi;colon" \065
+_sip._tcp SRV 10 20 5060 sip
+$ORIGIN sub.example.com.
+host	A 192.0.2.2
+$INCLUDE extra.zone
+`
+	if err := os.WriteFile(path, []byte(zone), 0644); err != nil {
+		t.Fatalf("Error writing zone file: %s", err.Error())
+	}
+
+	records, err := parseZoneFile(path, "example.com.")
+	if err != nil {
+		t.Fatalf("Error parsing zone file: %s", err.Error())
+	}
+	if len(records) != 10 {
+		t.Fatalf("Unexpected number of records %d", len(records))
+	}
+
+	expected := []struct {
+		name  string
+		rtype dnsmessage.Type
+		ttl   uint32
+	}{
+		{"example.com.", dnsmessage.TypeSOA, 3600},
+		{"example.com.", dnsmessage.TypeNS, 3600},
+		{"ns1.example.com.", dnsmessage.TypeA, 300},
+		{"www.example.com.", dnsmessage.TypeAAAA, 60},
+		{"alias.example.com.", dnsmessage.TypeCNAME, 3600},
+		{"alias.example.com.", dnsmessage.TypeMX, 3600},
+		{"txt.example.com.", dnsmessage.TypeTXT, 3600},
+		{"_sip._tcp.example.com.", dnsmessage.TypeSRV, 3600},
+		{"host.sub.example.com.", dnsmessage.TypeA, 3600},
+		{"extra.sub.example.com.", dnsmessage.TypeA, 3600},
+	}
+	for i, e := range expected {
+		h := records[i].Header
+		if h.Name.String() != e.name || h.Type != e.rtype || h.TTL != e.ttl || h.Class != dnsmessage.ClassINET {
+			t.Errorf("Unexpected record %d: %s %d %s", i, h.Name.String(), h.TTL, h.Type)
+		}
+	}
+
+	soa := records[0].Body.(*dnsmessage.SOAResource)
+	if soa.NS.String() != "ns1.example.com." || soa.Serial != 2024010101 || soa.Refresh != 86400 || soa.Expire != 2419200 || soa.MinTTL != 300 {
+		t.Errorf("Unexpected SOA record %+v", soa)
+	}
+	if cname := records[4].Body.(*dnsmessage.CNAMEResource); cname.CNAME.String() != "www.example.com." {
+		t.Errorf("Unexpected CNAME target %s", cname.CNAME.String())
+	}
+	txt := records[6].Body.(*dnsmessage.TXTResource)
+	if len(txt.TXT) != 3 || txt.TXT[0] != "hello world" || txt.TXT[1] != "semi;colon" || txt.TXT[2] != "A" {
+		t.Errorf("Unexpected TXT record %q", txt.TXT)
+	}
+
+	for _, bad := range []string{
+		"$TTL 60\nwww A not-an-ip\n",
+		"$TTL 60\nwww BOGUS data\n",
+		"$TTL 60\nwww A (192.0.2.1\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatalf("Error writing zone file: %s", err.Error())
+		}
+		if _, err := parseZoneFile(path, "example.com."); err == nil {
+			t.Errorf("No error seen for invalid zone file %q", bad)
+		}
+	}
+}